@@ -168,6 +168,27 @@ func AccountHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Remove the user from setlist songs they were assigned to perform
+		if _, err = tx.Exec("DELETE FROM setlist_performers WHERE user_id = $1", session.Values["user_id"]); err != nil {
+			log.Printf("Account DELETE - Unable to delete setlist performers for user %d.\n", session.Values["user_id"])
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Stop collaborating on setlists
+		if _, err = tx.Exec("DELETE FROM setlist_collaborators WHERE user_id = $1", session.Values["user_id"]); err != nil {
+			log.Printf("Account DELETE - Unable to delete setlist collaborators for user %d.\n", session.Values["user_id"])
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Delete saved searches
+		if _, err = tx.Exec("DELETE FROM saved_searches WHERE user_id = $1", session.Values["user_id"]); err != nil {
+			log.Printf("Account DELETE - Unable to delete saved searches for user %d.\n", session.Values["user_id"])
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
 		// Delete any password reset records
 		if _, err = tx.Exec("DELETE FROM password_reset WHERE user_id = $1", session.Values["user_id"]); err != nil {
 			log.Printf("Account DELETE - Unable to delete password reset record for user %d.\n", session.Values["user_id"])
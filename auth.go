@@ -430,9 +430,36 @@ func VerifyCollectionID(f http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// Levels of access to a setlist. Anyone in the collection can view a shared setlist,
+// collaborators can view or edit, and only the owner can delete it or change who can see it.
+const (
+	setlistNoAccess = iota
+	setlistViewAccess
+	setlistEditAccess
+	setlistOwnerAccess
+)
+
+// Names of the levels of access to a setlist, as sent to the client
+var setlistAccessNames = map[int]string{
+	setlistViewAccess:  "view",
+	setlistEditAccess:  "edit",
+	setlistOwnerAccess: "owner",
+}
+
 // VerifySetlistID is a middleware that checks if the user is authorized
 // to access a setlist, and returns a 403 Forbidden error if not.
+// GET requests need view access, and all other requests need edit access.
 func VerifySetlistID(f http.HandlerFunc) http.HandlerFunc {
+	return verifySetlistAccess(f, false)
+}
+
+// VerifySetlistViewer is a middleware like VerifySetlistID, but only needs view access
+// for every request, such as copying a setlist or leaving it as a collaborator.
+func VerifySetlistViewer(f http.HandlerFunc) http.HandlerFunc {
+	return verifySetlistAccess(f, true)
+}
+
+func verifySetlistAccess(f http.HandlerFunc, viewOnly bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		session, err := getSession(r)
 		if err != nil {
@@ -449,21 +476,87 @@ func VerifySetlistID(f http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		var userID int64
-		var shared bool
-		if err = db.QueryRow("SELECT user_id, shared FROM setlists WHERE setlist_id = $1", setlistID).Scan(&userID, &shared); err != nil {
-			log.Printf("Setlist ID middleware - Unable to get retrieve setlist user_id: %v\n", err)
+		userID, _ := session.Values["user_id"].(int64)
+		access, err := getSetlistAccess(setlistID, userID)
+		if err != nil {
+			log.Printf("Setlist ID middleware - Unable to get access to setlist %d: %v\n", setlistID, err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 
-		// Don't check user_id if setlist is shared
-		if !shared && userID != session.Values["user_id"].(int64) {
-			log.Printf("Setlist ID middleware - User %d attempted to access setlist owned by user %d.", session.Values["user_id"], userID)
+		if access == setlistNoAccess {
+			log.Printf("Setlist ID middleware - User %d attempted to access setlist %d.", userID, setlistID)
 			SendError(w, `{"error": "Setlist not found"}`, http.StatusNotFound)
 			return
 		}
 
+		if access < setlistEditAccess && r.Method != "GET" && !viewOnly {
+			log.Printf("Setlist ID middleware - User %d attempted to edit setlist %d without permission.", userID, setlistID)
+			SendError(w, `{"error": "You don't have permission to edit this setlist."}`, http.StatusForbidden)
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+// getSetlistAccess gets a user's level of access to a setlist, or setlistNoAccess if the setlist doesn't exist
+func getSetlistAccess(setlistID, userID int64) (int, error) {
+	var access int
+	err := db.QueryRow(`
+		SELECT CASE WHEN s.user_id = $2 THEN $3
+		            WHEN c.can_edit THEN $4
+		            WHEN c.user_id IS NOT NULL OR s.shared THEN $5
+		            ELSE $6 END
+		FROM setlists AS s
+		LEFT JOIN setlist_collaborators AS c ON c.setlist_id = s.setlist_id AND c.user_id = $2
+		WHERE s.setlist_id = $1`, setlistID, userID, setlistOwnerAccess, setlistEditAccess, setlistViewAccess, setlistNoAccess).Scan(&access)
+	if err == sql.ErrNoRows {
+		return setlistNoAccess, nil
+	}
+	return access, err
+}
+
+// VerifyShareLink is a middleware that checks a public setlist's share link hasn't expired,
+// and that the visitor has unlocked it if it has a password.
+func VerifyShareLink(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := getSession(r)
+		if err != nil {
+			log.Printf("Verify Share Link - Unable to get session: %v\n", err)
+			SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Get URL parameter
+		shareCode := mux.Vars(r)["share_code"]
+
+		var expired bool
+		var passwordChanged *time.Time
+		if err = db.QueryRow("SELECT COALESCE(share_expires < now(), false), share_password_changed FROM setlists WHERE share_code = $1 AND shared = true", shareCode).Scan(&expired, &passwordChanged); err != nil {
+			if err == sql.ErrNoRows {
+				log.Printf("Share Link middleware - No setlist found with share code '%v'\n", shareCode)
+				SendError(w, `{"error": "Setlist not found"}`, http.StatusNotFound)
+				return
+			}
+			log.Printf("Share Link middleware - Unable to get setlist from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if expired {
+			SendError(w, `{"error": "This share link has expired."}`, http.StatusGone)
+			return
+		}
+
+		// Visitors who unlocked the link before the password changed need the new password
+		if passwordChanged != nil {
+			if unlocked, _ := session.Values[shareLinkSessionKey(shareCode)].(int64); unlocked < passwordChanged.UnixNano() {
+				SendError(w, `{"error": "This setlist is protected by a password.", "password_required": true}`, http.StatusUnauthorized)
+				return
+			}
+		}
+
 		f(w, r)
 	}
 }
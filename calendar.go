@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gorilla/mux"
+)
+
+// Length of the token in calendar feed URLs
+const calendarTokenLength = 32
+
+// Lines in an iCalendar file are folded after this many bytes
+const icsLineLength = 75
+
+// CalendarFeed is the URL of a user's calendar feed
+type CalendarFeed struct {
+	URL string `json:"url"`
+}
+
+// calendarEvent is an event in an iCalendar file.
+// All day events only use the date of Start, and last until the next day without an End.
+type calendarEvent struct {
+	UID         string
+	Summary     string
+	Description string
+	Location    string
+	URL         string
+	Start       time.Time
+	End         *time.Time
+	AllDay      bool
+}
+
+// CalendarTokenHandler handles GETting the URL of the user's calendar feed, POSTing to replace it with a new URL,
+// and DELETEing it so the feed stops working. The URL is created the first time it is requested.
+func CalendarTokenHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Calendar Token handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	var token string
+	if r.Method == "GET" {
+		// Keep the current token so calendars that are already subscribed keep working
+		if err = db.QueryRow("UPDATE users SET calendar_token = COALESCE(calendar_token, $1) WHERE user_id = $2 RETURNING calendar_token", uniuri.NewLen(calendarTokenLength), session.Values["user_id"]).Scan(&token); err != nil {
+			log.Printf("Calendar Token GET - Unable to get calendar token from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+	} else if r.Method == "POST" {
+		token = uniuri.NewLen(calendarTokenLength)
+		if _, err = db.Exec("UPDATE users SET calendar_token = $1 WHERE user_id = $2", token, session.Values["user_id"]); err != nil {
+			log.Printf("Calendar Token POST - Unable to update calendar token in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+	} else if r.Method == "DELETE" {
+		if _, err = db.Exec("UPDATE users SET calendar_token = NULL WHERE user_id = $1", session.Values["user_id"]); err != nil {
+			log.Printf("Calendar Token DELETE - Unable to remove calendar token from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	} else {
+		return
+	}
+
+	// Send response
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(CalendarFeed{URL: "https://" + os.Getenv("HOST") + "/calendar/" + token + ".ics"})
+}
+
+// CalendarFeedHandler handles GETting a user's calendar feed, with the events and every dated setlist they can see in their collections.
+// Calendar apps can't sign in, so the user is found by the token in the URL.
+func CalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	token := mux.Vars(r)["token"]
+
+	if r.Method == "GET" {
+		var userID int64
+		if err := db.QueryRow("SELECT user_id FROM users WHERE calendar_token = $1", token).Scan(&userID); err != nil {
+			if err == sql.ErrNoRows {
+				log.Printf("Calendar Feed GET - No user found with calendar token '%v'\n", token)
+				SendError(w, `{"error": "Calendar not found."}`, http.StatusNotFound)
+				return
+			}
+			log.Printf("Calendar Feed GET - Unable to get user from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Own setlists, setlists shared with the collection, and setlists the user collaborates on
+		rows, err := db.Query(`
+			SELECT s.setlist_id, s.name, s.date, COALESCE(s.notes, ''), s.collection_id, c.name
+			FROM setlists AS s
+			JOIN collection_members AS m ON m.collection_id = s.collection_id AND m.user_id = $1
+			JOIN collections AS c ON c.collection_id = s.collection_id
+			WHERE s.date IS NOT NULL
+			  AND (s.user_id = $1 OR s.shared OR s.setlist_id IN (SELECT setlist_id FROM setlist_collaborators WHERE user_id = $1))
+			ORDER BY s.date, s.setlist_id`, userID)
+		if err != nil {
+			log.Printf("Calendar Feed GET - Unable to get setlists from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		type datedSetlist struct {
+			SetlistID    int64
+			Name         string
+			Date         time.Time
+			Notes        string
+			CollectionID int64
+			Collection   string
+		}
+		setlists := make([]datedSetlist, 0)
+		for rows.Next() {
+			var setlist datedSetlist
+			if err := rows.Scan(&setlist.SetlistID, &setlist.Name, &setlist.Date, &setlist.Notes, &setlist.CollectionID, &setlist.Collection); err != nil {
+				log.Printf("Calendar Feed GET - Unable to retrieve row from database result: %v\n", err)
+				continue
+			}
+			setlists = append(setlists, setlist)
+		}
+
+		// Check for errors from iterating over rows.
+		if err := rows.Err(); err != nil {
+			log.Printf("Calendar Feed GET - Unable to get setlists from database result: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		events := make([]calendarEvent, 0, len(setlists))
+		for _, setlist := range setlists {
+			event, err := setlistCalendarEvent(setlist.SetlistID, setlist.CollectionID, setlist.Name, setlist.Notes, setlist.Date)
+			if err != nil {
+				log.Printf("Calendar Feed GET - Unable to get songs in setlist %d: %v\n", setlist.SetlistID, err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+			event.Summary += " (" + setlist.Collection + ")"
+			events = append(events, event)
+		}
+
+		collectionIDs, err := getAuthorizedCollectionIDs(userID)
+		if err != nil {
+			log.Printf("Calendar Feed GET - Unable to get collections for user %d: %v\n", userID, err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		for _, collectionID := range collectionIDs {
+			collectionEvents, err := getEvents(collectionID, 0, false, userID)
+			if err != nil {
+				log.Printf("Calendar Feed GET - Unable to get events in collection %d: %v\n", collectionID, err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+			for _, event := range collectionEvents {
+				events = append(events, eventCalendarEvent(event))
+			}
+		}
+
+		sendCalendar(w, "Setlists", events, "")
+		return
+	}
+}
+
+// SetlistCalendarHandler handles GETting a single setlist as an iCalendar file
+func SetlistCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Calendar handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Calendar handler - Unable to parse setlist id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		var name, notes string
+		var date *time.Time
+		if err = db.QueryRow("SELECT name, date, COALESCE(notes, '') FROM setlists WHERE setlist_id = $1 AND collection_id = $2", setlistID, collectionID).Scan(&name, &date, &notes); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Setlist Calendar GET - Unable to get setlist from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if date == nil {
+			SendError(w, `{"error": "This setlist doesn't have a date."}`, http.StatusBadRequest)
+			return
+		}
+
+		event, err := setlistCalendarEvent(setlistID, collectionID, name, notes, *date)
+		if err != nil {
+			log.Printf("Setlist Calendar GET - Unable to get songs in setlist %d: %v\n", setlistID, err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		sendCalendar(w, name, []calendarEvent{event}, name)
+		return
+	}
+}
+
+// setlistCalendarEvent makes an all day event for a setlist, with its songs in the description and a link back to the setlist
+func setlistCalendarEvent(setlistID, collectionID int64, name, notes string, date time.Time) (calendarEvent, error) {
+	event := calendarEvent{
+		UID:     fmt.Sprintf("setlist-%d@%s", setlistID, os.Getenv("HOST")),
+		Summary: name,
+		URL:     fmt.Sprintf("https://%s/setlist.html?collection_id=%d&setlist_id=%d", os.Getenv("HOST"), collectionID, setlistID),
+		Start:   date,
+		AllDay:  true,
+	}
+
+	sections, runtime, _, err := getSetlistPlan(setlistID)
+	if err != nil {
+		return event, err
+	}
+
+	var description strings.Builder
+	if notes != "" {
+		description.WriteString(notes + "\n\n")
+	}
+	number := 0
+	for _, section := range sections {
+		if section.Name != "" {
+			description.WriteString(section.Name + "\n")
+		}
+		for _, item := range section.Items {
+			number++
+			description.WriteString(fmt.Sprintf("%d. %s", number, item.Name))
+			if item.Artist != "" {
+				description.WriteString(" - " + item.Artist)
+			}
+			description.WriteString("\n")
+		}
+	}
+	if runtime > 0 {
+		description.WriteString("Runtime " + formatDuration(runtime) + "\n")
+	}
+	description.WriteString("\n" + event.URL)
+	event.Description = description.String()
+
+	return event, nil
+}
+
+// eventCalendarEvent makes a calendar event for an event, with its call time, dress code and setlists in the description
+func eventCalendarEvent(event Event) calendarEvent {
+	calendar := calendarEvent{
+		UID:     fmt.Sprintf("event-%d@%s", event.EventID, os.Getenv("HOST")),
+		Summary: event.Name,
+		Start:   event.Start,
+		End:     event.End,
+	}
+
+	if event.Venue != nil {
+		calendar.Location = event.Venue.Name
+		if event.Venue.Address != "" {
+			calendar.Location += ", " + event.Venue.Address
+		}
+	}
+
+	details := make([]string, 0)
+	if event.CallTime != nil {
+		details = append(details, "Call time: "+event.CallTime.Format("Monday, January 2, 2006 3:04 PM MST"))
+	}
+	if event.DressCode != "" {
+		details = append(details, "Dress code: "+event.DressCode)
+	}
+	for _, setlist := range event.Setlists {
+		details = append(details, fmt.Sprintf("Setlist: %s https://%s/setlist.html?collection_id=%d&setlist_id=%d", setlist.Name, os.Getenv("HOST"), event.CollectionID, setlist.SetlistID))
+	}
+	if event.Notes != "" {
+		details = append(details, "", event.Notes)
+	}
+	calendar.Description = strings.Join(details, "\n")
+
+	return calendar
+}
+
+// sendCalendar writes events as an iCalendar file and sends it to the client.
+// With a file name, the calendar is downloaded instead of opened.
+func sendCalendar(w http.ResponseWriter, name string, events []calendarEvent, fileName string) {
+	var buffer bytes.Buffer
+	writeICSLine(&buffer, "BEGIN:VCALENDAR")
+	writeICSLine(&buffer, "VERSION:2.0")
+	writeICSLine(&buffer, "PRODID:-//Sheet Music Organizer//Setlists//EN")
+	writeICSLine(&buffer, "CALSCALE:GREGORIAN")
+	writeICSLine(&buffer, "X-WR-CALNAME:"+icsText(name))
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	for _, event := range events {
+		writeICSLine(&buffer, "BEGIN:VEVENT")
+		writeICSLine(&buffer, "UID:"+event.UID)
+		writeICSLine(&buffer, "DTSTAMP:"+stamp)
+		if event.AllDay {
+			writeICSLine(&buffer, "DTSTART;VALUE=DATE:"+event.Start.Format("20060102"))
+			end := event.Start.AddDate(0, 0, 1)
+			if event.End != nil {
+				end = *event.End
+			}
+			writeICSLine(&buffer, "DTEND;VALUE=DATE:"+end.Format("20060102"))
+		} else {
+			writeICSLine(&buffer, "DTSTART:"+event.Start.UTC().Format("20060102T150405Z"))
+			if event.End != nil {
+				writeICSLine(&buffer, "DTEND:"+event.End.UTC().Format("20060102T150405Z"))
+			}
+		}
+		writeICSLine(&buffer, "SUMMARY:"+icsText(event.Summary))
+		if event.Description != "" {
+			writeICSLine(&buffer, "DESCRIPTION:"+icsText(event.Description))
+		}
+		if event.Location != "" {
+			writeICSLine(&buffer, "LOCATION:"+icsText(event.Location))
+		}
+		if event.URL != "" {
+			writeICSLine(&buffer, "URL:"+event.URL)
+		}
+		writeICSLine(&buffer, "END:VEVENT")
+	}
+	writeICSLine(&buffer, "END:VCALENDAR")
+
+	w.Header().Add("Content-Type", "text/calendar; charset=utf-8")
+	if fileName != "" {
+		if fileName = strings.TrimSpace(fileNamePattern.ReplaceAllString(fileName, "")); fileName == "" {
+			fileName = "Setlist"
+		}
+		w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.ics"`, fileName))
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(buffer.Bytes()); err != nil {
+		log.Printf("Calendar - Unable to send calendar to client: %v\n", err)
+	}
+}
+
+// icsText escapes text for an iCalendar property value
+func icsText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// writeICSLine writes a line of an iCalendar file, folding it so no line is longer than icsLineLength bytes.
+// Lines are only folded between characters, so multi-byte characters aren't split.
+func writeICSLine(buffer *bytes.Buffer, line string) {
+	length := 0
+	for _, character := range line {
+		size := len(string(character))
+		if length+size > icsLineLength {
+			buffer.WriteString("\r\n ")
+			length = 1
+		}
+		buffer.WriteRune(character)
+		length += size
+	}
+	buffer.WriteString("\r\n")
+}
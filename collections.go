@@ -257,30 +257,117 @@ func deleteCollection(collectionID int64, tx *sql.Tx) error {
 		return err
 	}
 
-	// Remove songs from setlists
-	if _, err := tx.Exec("DELETE FROM setlist_songs WHERE song_id IN (SELECT song_id FROM songs WHERE collection_id = $1)", collectionID); err != nil {
+	// Remove performers from setlist songs
+	if _, err := tx.Exec("DELETE FROM setlist_performers WHERE item_id IN (SELECT item_id FROM setlist_songs WHERE setlist_id IN (SELECT setlist_id FROM setlists WHERE collection_id = $1))", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete setlist performers from collection: %v\n", err)
+		return err
+	}
+
+	// Remove songs and free text items from setlists
+	if _, err := tx.Exec("DELETE FROM setlist_songs WHERE song_id IN (SELECT song_id FROM songs WHERE collection_id = $1) OR setlist_id IN (SELECT setlist_id FROM setlists WHERE collection_id = $1)", collectionID); err != nil {
 		log.Printf("deleteCollection - Unable to delete songs from collection: %v\n", err)
 		return err
 	}
 
+	// Remove saved searches
+	if _, err := tx.Exec("DELETE FROM saved_searches WHERE collection_id = $1", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete saved searches from collection: %v\n", err)
+		return err
+	}
+
+	// Remove setlist collaborators
+	if _, err := tx.Exec("DELETE FROM setlist_collaborators WHERE setlist_id IN (SELECT setlist_id FROM setlists WHERE collection_id = $1)", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete setlist collaborators from collection: %v\n", err)
+		return err
+	}
+
+	// Remove rehearsals
+	if _, err := tx.Exec("DELETE FROM rehearsal_songs WHERE rehearsal_id IN (SELECT rehearsal_id FROM rehearsals WHERE collection_id = $1)", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete rehearsal songs from collection: %v\n", err)
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM rehearsals WHERE collection_id = $1", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete rehearsals from collection: %v\n", err)
+		return err
+	}
+
+	// Remove setlists from events
+	if _, err := tx.Exec("DELETE FROM event_setlists WHERE event_id IN (SELECT event_id FROM events WHERE collection_id = $1)", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete event setlists from collection: %v\n", err)
+		return err
+	}
+
+	// Remove setlist share link history
+	if _, err := tx.Exec("DELETE FROM setlist_share_links WHERE setlist_id IN (SELECT setlist_id FROM setlists WHERE collection_id = $1)", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete setlist share links from collection: %v\n", err)
+		return err
+	}
+
+	// Remove setlist sections
+	if _, err := tx.Exec("DELETE FROM setlist_sections WHERE setlist_id IN (SELECT setlist_id FROM setlists WHERE collection_id = $1)", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete setlist sections from collection: %v\n", err)
+		return err
+	}
+
 	// Remove setlists
 	if _, err := tx.Exec("DELETE FROM setlists WHERE collection_id = $1", collectionID); err != nil {
 		log.Printf("deleteCollection - Unable to delete songs from collection: %v\n", err)
 		return err
 	}
 
+	// Remove setlist templates
+	if _, err := tx.Exec("DELETE FROM setlist_template_slots WHERE template_id IN (SELECT template_id FROM setlist_templates WHERE collection_id = $1)", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete setlist template slots from collection: %v\n", err)
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM setlist_templates WHERE collection_id = $1", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete setlist templates from collection: %v\n", err)
+		return err
+	}
+
+	// Remove performance history
+	if _, err := tx.Exec("DELETE FROM song_performances WHERE song_id IN (SELECT song_id FROM songs WHERE collection_id = $1)", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete performances from collection: %v\n", err)
+		return err
+	}
+
+	// Remove events and venues
+	if _, err := tx.Exec("DELETE FROM events WHERE collection_id = $1", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete events from collection: %v\n", err)
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM venues WHERE collection_id = $1", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete venues from collection: %v\n", err)
+		return err
+	}
+
 	// Remove songs from collection
 	if _, err := tx.Exec("DELETE FROM songs WHERE collection_id = $1", collectionID); err != nil {
 		log.Printf("deleteCollection - Unable to delete songs from collection: %v\n", err)
 		return err
 	}
 
+	// Remove tagging rules from collection
+	if _, err := tx.Exec("DELETE FROM tag_rules WHERE collection_id = $1", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete tag rules from collection: %v\n", err)
+		return err
+	}
+
 	// Remove tags from collection
 	if _, err := tx.Exec("DELETE FROM tags WHERE collection_id = $1", collectionID); err != nil {
 		log.Printf("deleteCollection - Unable to delete tags from collection: %v\n", err)
 		return err
 	}
 
+	// Remove tag categories from collection
+	if _, err := tx.Exec("DELETE FROM tag_categories WHERE collection_id = $1", collectionID); err != nil {
+		log.Printf("deleteCollection - Unable to delete tag categories from collection: %v\n", err)
+		return err
+	}
+
 	// Remove users from collection
 	if _, err := tx.Exec("DELETE FROM collection_members WHERE collection_id = $1", collectionID); err != nil {
 		log.Printf("deleteCollection - Unable to delete collection members: %v\n", err)
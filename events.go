@@ -0,0 +1,452 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Event is a struct that models a performance or other dated event, both in the request body, and in the DB.
+// The call time is when performers need to arrive.
+type Event struct {
+	EventID      int64      `json:"event_id" db:"event_id"`
+	Name         string     `json:"name" db:"name"`
+	Start        time.Time  `json:"start" db:"start_time"`
+	End          *time.Time `json:"end,omitempty" db:"end_time"`
+	CallTime     *time.Time `json:"call_time,omitempty" db:"call_time"`
+	DressCode    string     `json:"dress_code,omitempty" db:"dress_code"`
+	Notes        string     `json:"notes,omitempty" db:"notes"`
+	VenueID      *int64     `json:"venue_id,omitempty" db:"venue_id"`
+	CollectionID int64      `json:"collection_id" db:"collection_id"`
+
+	// Setlists performed at the event. Updating an event replaces the setlists the user can see with SetlistIDs.
+	SetlistIDs []int64        `json:"setlist_ids"`
+	Setlists   []EventSetlist `json:"setlists,omitempty"`
+	Venue      *Venue         `json:"venue,omitempty"`
+}
+
+// EventSetlist is a setlist linked to an event
+type EventSetlist struct {
+	SetlistID int64  `json:"setlist_id"`
+	Name      string `json:"name"`
+}
+
+// EventsHandler handles GETting all events or POSTing a new event.
+// With ?upcoming=true, only events that haven't finished are returned.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Events handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Events handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		events, err := getEvents(collectionID, 0, r.URL.Query().Get("upcoming") == "true", session.Values["user_id"].(int64))
+		if err != nil {
+			log.Printf("Events GET - Unable to retrieve events from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(events)
+		return
+
+	} else if r.Method == "POST" {
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Events POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		event.CollectionID = collectionID
+		if message, err := checkEvent(&event, session.Values["user_id"].(int64)); err != nil {
+			log.Printf("Events POST - Unable to check event: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Events POST - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Create event in database
+		if err = tx.QueryRow("INSERT INTO events(name, start_time, end_time, call_time, dress_code, notes, venue_id, collection_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING event_id",
+			event.Name, event.Start, event.End, event.CallTime, event.DressCode, event.Notes, event.VenueID, collectionID).Scan(&event.EventID); err != nil {
+			log.Printf("Events POST - Unable to insert event in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Events POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = insertEventSetlists(tx, event.EventID, event.SetlistIDs); err != nil {
+			log.Printf("Events POST - Unable to link setlists to event: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Events POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Events POST - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(event)
+		return
+	}
+}
+
+// EventHandler handles GETting, updating, or deleting a single event.
+func EventHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Event handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Event handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	eventID, err := strconv.ParseInt(mux.Vars(r)["event_id"], 10, 64)
+	if err != nil {
+		log.Printf("Event handler - Unable to parse event id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		events, err := getEvents(collectionID, eventID, false, session.Values["user_id"].(int64))
+		if err != nil {
+			log.Printf("Event GET - Unable to get event from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if len(events) == 0 {
+			SendError(w, `{"error": "Event not found."}`, http.StatusNotFound)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(events[0])
+		return
+
+	} else if r.Method == "PUT" {
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Event PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Use the URL IDs so the user can't update another record
+		event.EventID = eventID
+		event.CollectionID = collectionID
+
+		// Input validation
+		if message, err := checkEvent(&event, session.Values["user_id"].(int64)); err != nil {
+			log.Printf("Event PUT - Unable to check event: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Event PUT - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Update event in database
+		result, err := tx.Exec("UPDATE events SET name = $1, start_time = $2, end_time = $3, call_time = $4, dress_code = $5, notes = $6, venue_id = $7 WHERE event_id = $8 AND collection_id = $9",
+			event.Name, event.Start, event.End, event.CallTime, event.DressCode, event.Notes, event.VenueID, eventID, collectionID)
+		if err != nil {
+			log.Printf("Event PUT - Unable to update event in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Event PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Check if update did anything
+		if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Event PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			if err != nil {
+				log.Printf("Event PUT - Database update unsuccessful: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			} else {
+				SendError(w, `{"error": "Event not found."}`, http.StatusNotFound)
+			}
+			return
+		}
+
+		// Replace the event's setlists. Links to setlists the user can't see are left in place.
+		if _, err = tx.Exec(`
+			DELETE FROM event_setlists
+			WHERE event_id = $1
+			  AND setlist_id IN (SELECT setlist_id FROM setlists
+			                     WHERE user_id = $2 OR shared OR setlist_id IN (SELECT setlist_id FROM setlist_collaborators WHERE user_id = $2))`,
+			eventID, session.Values["user_id"].(int64)); err != nil {
+			log.Printf("Event PUT - Unable to remove setlists from event: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Event PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = insertEventSetlists(tx, eventID, event.SetlistIDs); err != nil {
+			log.Printf("Event PUT - Unable to link setlists to event: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Event PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Event PUT - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+
+	} else if r.Method == "DELETE" {
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Event DELETE - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = deleteEvent(eventID, collectionID, tx); err != nil {
+			log.Printf("Event DELETE - Unable to delete event %d: %v\n", eventID, err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Event DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Event DELETE - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
+
+// getEvents gets the events in a collection in the order they happen, with their venues and the setlists the user can see.
+// Use an eventID of 0 for all events in the collection.
+func getEvents(collectionID, eventID int64, upcoming bool, userID int64) ([]Event, error) {
+	rows, err := db.Query(`
+		SELECT e.event_id, e.name, e.start_time, e.end_time, e.call_time, COALESCE(e.dress_code, ''), COALESCE(e.notes, ''),
+		       e.venue_id, COALESCE(v.name, ''), COALESCE(v.address, ''), COALESCE(v.notes, '')
+		FROM events AS e
+		LEFT JOIN venues AS v ON v.venue_id = e.venue_id
+		WHERE e.collection_id = $1
+		  AND ($2 = 0 OR e.event_id = $2)
+		  AND (NOT $3 OR COALESCE(e.end_time, e.start_time) >= now())
+		ORDER BY e.start_time, e.event_id`, collectionID, eventID, upcoming)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0)
+	eventIDs := make([]int64, 0)
+	for rows.Next() {
+		event := Event{CollectionID: collectionID, SetlistIDs: make([]int64, 0), Setlists: make([]EventSetlist, 0)}
+		var venue Venue
+		if err := rows.Scan(&event.EventID, &event.Name, &event.Start, &event.End, &event.CallTime, &event.DressCode, &event.Notes,
+			&event.VenueID, &venue.Name, &venue.Address, &venue.Notes); err != nil {
+			return nil, err
+		}
+		if event.VenueID != nil {
+			venue.VenueID = *event.VenueID
+			venue.CollectionID = collectionID
+			event.Venue = &venue
+		}
+		events = append(events, event)
+		eventIDs = append(eventIDs, event.EventID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Add the setlists the user can see
+	setlistRows, err := db.Query(`
+		SELECT es.event_id, s.setlist_id, s.name
+		FROM event_setlists AS es
+		JOIN setlists AS s ON s.setlist_id = es.setlist_id
+		WHERE es.event_id = ANY($1)
+		  AND (s.user_id = $2 OR s.shared OR s.setlist_id IN (SELECT setlist_id FROM setlist_collaborators WHERE user_id = $2))
+		ORDER BY s.name`, pq.Array(eventIDs), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer setlistRows.Close()
+
+	positions := make(map[int64]int)
+	for i, event := range events {
+		positions[event.EventID] = i
+	}
+	for setlistRows.Next() {
+		var eventID int64
+		var setlist EventSetlist
+		if err := setlistRows.Scan(&eventID, &setlist.SetlistID, &setlist.Name); err != nil {
+			return nil, err
+		}
+		event := &events[positions[eventID]]
+		event.SetlistIDs = append(event.SetlistIDs, setlist.SetlistID)
+		event.Setlists = append(event.Setlists, setlist)
+	}
+
+	return events, setlistRows.Err()
+}
+
+// checkEvent verifies an event's times, venue and setlists. It returns an error message
+// for the client if they are not allowed. Setlists must be in the collection and visible to the user.
+func checkEvent(event *Event, userID int64) (string, error) {
+	if event.Name == "" {
+		return `{"error": "No event name supplied."}`, nil
+	}
+
+	if event.Start.IsZero() {
+		return `{"error": "No event start time supplied."}`, nil
+	}
+
+	if event.End != nil && event.End.Before(event.Start) {
+		return `{"error": "An event can't end before it starts."}`, nil
+	}
+
+	if event.CallTime != nil && event.CallTime.After(event.Start) {
+		return `{"error": "The call time can't be after the event starts."}`, nil
+	}
+
+	if event.VenueID != nil {
+		var venues int
+		if err := db.QueryRow("SELECT count(*) FROM venues WHERE venue_id = $1 AND collection_id = $2", *event.VenueID, event.CollectionID).Scan(&venues); err != nil {
+			return "", err
+		} else if venues == 0 {
+			return `{"error": "Venue not found."}`, nil
+		}
+	}
+
+	event.SetlistIDs = uniqueIDs(event.SetlistIDs)
+	if len(event.SetlistIDs) > 0 {
+		var setlists int
+		if err := db.QueryRow(`
+			SELECT count(*) FROM setlists
+			WHERE setlist_id = ANY($1) AND collection_id = $2
+			  AND (user_id = $3 OR shared OR setlist_id IN (SELECT setlist_id FROM setlist_collaborators WHERE user_id = $3))`,
+			pq.Array(event.SetlistIDs), event.CollectionID, userID).Scan(&setlists); err != nil {
+			return "", err
+		} else if setlists != len(event.SetlistIDs) {
+			return `{"error": "Setlist not found."}`, nil
+		}
+	}
+
+	return "", nil
+}
+
+// insertEventSetlists links setlists to an event
+func insertEventSetlists(tx *sql.Tx, eventID int64, setlistIDs []int64) error {
+	for _, setlistID := range setlistIDs {
+		if _, err := tx.Exec("INSERT INTO event_setlists(event_id, setlist_id) VALUES ($1, $2)", eventID, setlistID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteEvent deletes an event. Performances at the event are kept in the songs' performance history,
+// and rehearsals for the event are kept for the songs' readiness.
+func deleteEvent(eventID, collectionID int64, tx *sql.Tx) error {
+	// Remove setlists from event
+	if _, err := tx.Exec("DELETE FROM event_setlists WHERE event_id IN (SELECT event_id FROM events WHERE event_id = $1 AND collection_id = $2)", eventID, collectionID); err != nil {
+		log.Printf("deleteEvent - Unable to delete setlists from event: %v\n", err)
+		return err
+	}
+
+	// Keep performances without the event
+	if _, err := tx.Exec("UPDATE song_performances SET event_id = NULL WHERE event_id IN (SELECT event_id FROM events WHERE event_id = $1 AND collection_id = $2)", eventID, collectionID); err != nil {
+		log.Printf("deleteEvent - Unable to remove event from performances: %v\n", err)
+		return err
+	}
+
+	// Keep rehearsals without the event
+	if _, err := tx.Exec("UPDATE rehearsals SET event_id = NULL WHERE event_id IN (SELECT event_id FROM events WHERE event_id = $1 AND collection_id = $2)", eventID, collectionID); err != nil {
+		log.Printf("deleteEvent - Unable to remove event from rehearsals: %v\n", err)
+		return err
+	}
+
+	// Delete event
+	if _, err := tx.Exec("DELETE FROM events WHERE event_id = $1 AND collection_id = $2", eventID, collectionID); err != nil {
+		log.Printf("deleteEvent - Unable to delete event: %v\n", err)
+		return err
+	}
+
+	return nil
+}
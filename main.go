@@ -36,38 +36,98 @@ func makeRouter() *mux.Router {
 	r.HandleFunc("/user/password/reset", resetPassword)
 	r.HandleFunc("/user/account", RequireAuthentication(AccountHandler)).Methods("GET", "PUT", "DELETE")
 	r.HandleFunc("/user/verify", RequireAuthentication(VerifyHandler)).Methods("GET", "POST")
+	r.HandleFunc("/user/calendar", RequireAuthentication(CalendarTokenHandler)).Methods("GET", "POST", "DELETE")
+	r.HandleFunc("/calendar/{token}.ics", CalendarFeedHandler).Methods("GET")
 	r.HandleFunc("/invitations", RequireAuthentication(InvitationsHandler)).Methods("GET", "POST")
 	r.HandleFunc("/user/invitations", RequireAuthentication(UserInvitationsHandler)).Methods("GET", "POST")
 
 	// Collections
 	r.HandleFunc("/collections", RequireAuthentication(CollectionsHandler)).Methods("GET", "POST")
+	r.HandleFunc("/search", RequireAuthentication(GlobalSearchHandler)).Methods("GET")
 	r.HandleFunc("/collections/{collection_id}", VerifyCollectionID(RequireAuthentication(CollectionHandler))).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/collections/{collection_id}/catalog", VerifyCollectionID(RequireAuthentication(CollectionCatalogHandler))).Methods("GET", "PUT")
 	r.HandleFunc("/collections/{collection_id}/members", VerifyCollectionID(RequireAuthentication(MembersHandler))).Methods("GET")
 	r.HandleFunc("/collections/{collection_id}/members/{user_id}", VerifyCollectionID(RequireAuthentication(MemberHandler))).Methods("PUT", "DELETE")
 	r.HandleFunc("/collections/{collection_id}/invitations", VerifyCollectionID(RequireAuthentication(CollectionInvitationsHandler))).Methods("GET", "POST")
 	r.HandleFunc("/collections/{collection_id}/invitations/{invitation_id}", VerifyCollectionID(RequireAuthentication(CollectionInvitationsHandler))).Methods("DELETE")
 	r.HandleFunc("/collections/{collection_id}/search", VerifyCollectionID(RequireAuthentication(SearchHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/searches", VerifyCollectionID(RequireAuthentication(SavedSearchesHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/searches/{saved_search_id}", VerifyCollectionID(RequireAuthentication(SavedSearchHandler))).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/collections/{collection_id}/searches/{saved_search_id}/songs", VerifyCollectionID(RequireAuthentication(SavedSearchSongsHandler))).Methods("GET")
 
 	// Songs
 	r.HandleFunc("/collections/{collection_id}/songs", VerifyCollectionID(RequireAuthentication(SongsHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/songs/tags", VerifyCollectionID(RequireAuthentication(BulkSongTagsHandler))).Methods("POST")
+	r.HandleFunc("/collections/{collection_id}/songs/suggest", VerifyCollectionID(RequireAuthentication(SongSuggestionsHandler))).Methods("GET")
 	r.HandleFunc("/collections/{collection_id}/songs/{song_id}", VerifyCollectionID(RequireAuthentication(SongHandler))).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/collections/{collection_id}/songs/{song_id}/performances", VerifyCollectionID(RequireAuthentication(SongPerformancesHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/songs/{song_id}/performances/{performance_id}", VerifyCollectionID(RequireAuthentication(SongPerformanceHandler))).Methods("DELETE")
 	r.HandleFunc("/collections/{collection_id}/songs/{song_id}/tags", VerifyCollectionID(RequireAuthentication(SongTagsHandler))).Methods("GET", "POST", "DELETE")
 
 	// Tags
 	r.HandleFunc("/collections/{collection_id}/tags", VerifyCollectionID(RequireAuthentication(TagsHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/tags/tree", VerifyCollectionID(RequireAuthentication(TagTreeHandler))).Methods("GET")
+	r.HandleFunc("/collections/{collection_id}/tags/rename", VerifyCollectionID(RequireAuthentication(TagRenameHandler))).Methods("POST")
 	r.HandleFunc("/collections/{collection_id}/tags/{tag_id}", VerifyCollectionID(RequireAuthentication(TagHandler))).Methods("GET", "PUT", "DELETE")
 	r.HandleFunc("/collections/{collection_id}/tags/{tag_id}/songs", VerifyCollectionID(RequireAuthentication(TagSongsHandler))).Methods("GET")
+	r.HandleFunc("/collections/{collection_id}/tags/{tag_id}/merge", VerifyCollectionID(RequireAuthentication(TagMergeHandler))).Methods("POST")
+	r.HandleFunc("/collections/{collection_id}/tags/{tag_id}/split", VerifyCollectionID(RequireAuthentication(TagSplitHandler))).Methods("POST")
+
+	// Tagging rules
+	r.HandleFunc("/collections/{collection_id}/rules", VerifyCollectionID(RequireAuthentication(TagRulesHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/rules/apply", VerifyCollectionID(RequireAuthentication(TagRulesApplyHandler))).Methods("POST")
+	r.HandleFunc("/collections/{collection_id}/rules/{rule_id}", VerifyCollectionID(RequireAuthentication(TagRuleHandler))).Methods("GET", "PUT", "DELETE")
+
+	// Tag categories
+	r.HandleFunc("/collections/{collection_id}/categories", VerifyCollectionID(RequireAuthentication(TagCategoriesHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/categories/{category_id}", VerifyCollectionID(RequireAuthentication(TagCategoryHandler))).Methods("GET", "PUT", "DELETE")
 
 	// Setlists
 	r.HandleFunc("/collections/{collection_id}/setlists", VerifyCollectionID(RequireAuthentication(SetlistsHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/setlists/suggest", VerifyCollectionID(RequireAuthentication(SetlistSuggestionHandler))).Methods("POST")
 	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistHandler)))).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/program.pdf", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistProgramHandler)))).Methods("GET")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/binder.pdf", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistBinderHandler)))).Methods("GET")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/calendar.ics", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistCalendarHandler)))).Methods("GET")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/copy", VerifySetlistViewer(VerifyCollectionID(RequireAuthentication(SetlistCopyHandler)))).Methods("POST")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/owner", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistOwnerHandler)))).Methods("PUT")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/collaborators", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistCollaboratorsHandler)))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/collaborators/{user_id}", VerifySetlistViewer(VerifyCollectionID(RequireAuthentication(SetlistCollaboratorHandler)))).Methods("PUT", "DELETE")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/share", VerifySetlistViewer(VerifyCollectionID(RequireAuthentication(SetlistShareHandler)))).Methods("GET", "PUT")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/share/rotate", VerifySetlistViewer(VerifyCollectionID(RequireAuthentication(SetlistShareRotateHandler)))).Methods("POST")
 	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/visibility", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistVisibilityHandler)))).Methods("PUT")
 	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/songs", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistSongsHandler)))).Methods("GET", "POST", "PUT")
-	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/songs/{song_id}", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistSongHandler)))).Methods("DELETE")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/items", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistItemsHandler)))).Methods("POST")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/items/{item_id}", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistSongHandler)))).Methods("PUT", "DELETE")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/sections", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistSectionsHandler)))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/setlists/{setlist_id}/sections/{section_id}", VerifySetlistID(VerifyCollectionID(RequireAuthentication(SetlistSectionHandler)))).Methods("PUT", "DELETE")
+
+	// Events and venues
+	r.HandleFunc("/collections/{collection_id}/events", VerifyCollectionID(RequireAuthentication(EventsHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/events/{event_id}", VerifyCollectionID(RequireAuthentication(EventHandler))).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/collections/{collection_id}/events/{event_id}/performances", VerifyCollectionID(RequireAuthentication(EventPerformancesHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/venues", VerifyCollectionID(RequireAuthentication(VenuesHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/venues/{venue_id}", VerifyCollectionID(RequireAuthentication(VenueHandler))).Methods("GET", "PUT", "DELETE")
+
+	// Rehearsals
+	r.HandleFunc("/collections/{collection_id}/rehearsals", VerifyCollectionID(RequireAuthentication(RehearsalsHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/rehearsals/readiness", VerifyCollectionID(RequireAuthentication(RehearsalReadinessHandler))).Methods("GET")
+	r.HandleFunc("/collections/{collection_id}/rehearsals/{rehearsal_id}", VerifyCollectionID(RequireAuthentication(RehearsalHandler))).Methods("GET", "PUT", "DELETE")
+
+	// Setlist templates
+	r.HandleFunc("/collections/{collection_id}/templates", VerifyCollectionID(RequireAuthentication(SetlistTemplatesHandler))).Methods("GET", "POST")
+	r.HandleFunc("/collections/{collection_id}/templates/{template_id}", VerifyCollectionID(RequireAuthentication(SetlistTemplateHandler))).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/collections/{collection_id}/templates/{template_id}/setlists", VerifyCollectionID(RequireAuthentication(SetlistFromTemplateHandler))).Methods("POST")
+
+	// Public catalog
+	r.HandleFunc("/catalogs/{share_code}", PublicCatalogHandler).Methods("GET")
+	r.HandleFunc("/catalogs/{share_code}/songs", PublicCatalogSongsHandler).Methods("GET")
 
 	// Public setlist
-	r.HandleFunc("/setlists/{share_code}", PublicSetlistHandler).Methods("GET")
-	r.HandleFunc("/setlists/{share_code}/songs", PublicSetlistSongsHandler).Methods("GET")
+	r.HandleFunc("/setlists/{share_code}", VerifyShareLink(PublicSetlistHandler)).Methods("GET")
+	r.HandleFunc("/setlists/{share_code}/unlock", PublicSetlistUnlockHandler).Methods("POST")
+	r.HandleFunc("/setlists/{share_code}/songs", VerifyShareLink(PublicSetlistSongsHandler)).Methods("GET")
+	r.HandleFunc("/setlists/{share_code}/program.pdf", VerifyShareLink(PublicSetlistProgramHandler)).Methods("GET")
 
 	// Contact Us
 	r.HandleFunc("/contact", ContactHandler).Methods("POST")
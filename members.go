@@ -206,6 +206,13 @@ func MemberHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		// Members who leave can no longer collaborate on the collection's setlists
+		if _, err = db.Exec("DELETE FROM setlist_collaborators WHERE user_id = $1 AND setlist_id IN (SELECT setlist_id FROM setlists WHERE collection_id = $2)", targetUserID, collectionID); err != nil {
+			log.Printf("Collection Member DELETE - Unable to delete setlist collaborators: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
 		// Remove target user from collection
 		if _, err = db.Exec("DELETE FROM collection_members WHERE user_id = $1 AND collection_id = $2", targetUserID, collectionID); err != nil {
 			log.Printf("Collection Member DELETE - Unable to delete collection member: %v\n", err)
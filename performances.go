@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Performance is a struct that models a time a song was performed, both in the request body, and in the DB.
+// A performance can be at an event, and uses the event's date unless a date is given.
+type Performance struct {
+	PerformanceID int64      `json:"performance_id" db:"performance_id"`
+	SongID        int64      `json:"song_id" db:"song_id"`
+	Song          string     `json:"song,omitempty"`
+	Date          *time.Time `json:"date" db:"date"`
+	EventID       *int64     `json:"event_id,omitempty" db:"event_id"`
+	Event         string     `json:"event,omitempty"`
+	Notes         string     `json:"notes,omitempty" db:"notes"`
+}
+
+// SongPerformancesHandler handles GETting the performance history of a song and POSTing a new performance.
+// Recording a performance updates the song's last performed date.
+func SongPerformancesHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Song Performances handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	songID, err := strconv.ParseInt(mux.Vars(r)["song_id"], 10, 64)
+	if err != nil {
+		log.Printf("Song Performances handler - Unable to parse song id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	// Verify Song ID
+	var songName string
+	if err = db.QueryRow("SELECT name FROM songs WHERE song_id = $1 AND collection_id = $2", songID, collectionID).Scan(&songName); err != nil {
+		if err == sql.ErrNoRows {
+			SendError(w, `{"error": "Song not found."}`, http.StatusNotFound)
+		} else {
+			log.Printf("Song Performances handler - Unable to get song from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if r.Method == "GET" {
+		rows, err := db.Query(`
+			SELECT p.performance_id, p.date, p.event_id, COALESCE(e.name, ''), COALESCE(p.notes, '')
+			FROM song_performances AS p
+			LEFT JOIN events AS e ON e.event_id = p.event_id
+			WHERE p.song_id = $1
+			ORDER BY p.date DESC, p.performance_id DESC`, songID)
+		if err != nil {
+			log.Printf("Song Performances GET - Unable to retrieve performances from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// Retrieve rows from database
+		performances := make([]Performance, 0)
+		for rows.Next() {
+			performance := Performance{SongID: songID, Song: songName}
+			if err := rows.Scan(&performance.PerformanceID, &performance.Date, &performance.EventID, &performance.Event, &performance.Notes); err != nil {
+				log.Printf("Song Performances GET - Unable to retrieve row from database result: %v\n", err)
+				continue
+			}
+			performances = append(performances, performance)
+		}
+
+		// Check for errors from iterating over rows.
+		if err := rows.Err(); err != nil {
+			log.Printf("Song Performances GET - Unable to get performances from database result: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(performances)
+		return
+
+	} else if r.Method == "POST" {
+		var performance Performance
+		if err := json.NewDecoder(r.Body).Decode(&performance); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Song Performances POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+		performance.SongID = songID
+		performance.Song = songName
+
+		// Input validation
+		if performance.EventID != nil {
+			var eventDate time.Time
+			if err = db.QueryRow("SELECT name, start_time::date FROM events WHERE event_id = $1 AND collection_id = $2", *performance.EventID, collectionID).Scan(&performance.Event, &eventDate); err != nil {
+				if err == sql.ErrNoRows {
+					SendError(w, `{"error": "Event not found."}`, http.StatusBadRequest)
+				} else {
+					log.Printf("Song Performances POST - Unable to get event from database: %v\n", err)
+					SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				}
+				return
+			}
+			if performance.Date == nil {
+				performance.Date = &eventDate
+			}
+		}
+
+		if performance.Date == nil {
+			SendError(w, `{"error": "No performance date supplied."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Song Performances POST - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.QueryRow("INSERT INTO song_performances(song_id, date, event_id, notes) VALUES ($1, $2, $3, $4) RETURNING performance_id",
+			songID, performance.Date, performance.EventID, performance.Notes).Scan(&performance.PerformanceID); err != nil {
+			log.Printf("Song Performances POST - Unable to insert performance in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Song Performances POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("UPDATE songs SET last_performed = GREATEST(last_performed, $1) WHERE song_id = $2", performance.Date, songID); err != nil {
+			log.Printf("Song Performances POST - Unable to update last performed date: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Song Performances POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Song Performances POST - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(performance)
+		return
+	}
+}
+
+// SongPerformanceHandler handles deleting a performance from a song's history.
+// If the song's last performed date came from the deleted performance, it goes back to the latest remaining one.
+func SongPerformanceHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Song Performance handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	songID, err := strconv.ParseInt(mux.Vars(r)["song_id"], 10, 64)
+	if err != nil {
+		log.Printf("Song Performance handler - Unable to parse song id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	performanceID, err := strconv.ParseInt(mux.Vars(r)["performance_id"], 10, 64)
+	if err != nil {
+		log.Printf("Song Performance handler - Unable to parse performance id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Song Performance DELETE - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		var date *time.Time
+		if err = tx.QueryRow("DELETE FROM song_performances WHERE performance_id = $1 AND song_id IN (SELECT song_id FROM songs WHERE song_id = $2 AND collection_id = $3) RETURNING date",
+			performanceID, songID, collectionID).Scan(&date); err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Song Performance DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Performance not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Song Performance DELETE - Unable to delete performance from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Recompute the last performed date from the remaining performances
+		if _, err = tx.Exec("UPDATE songs SET last_performed = (SELECT max(date) FROM song_performances WHERE song_id = $1) WHERE song_id = $1 AND last_performed = $2", songID, date); err != nil {
+			log.Printf("Song Performance DELETE - Unable to update song's last performed date: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Song Performance DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Song Performance DELETE - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
+
+// EventPerformancesHandler handles GETting the songs performed at an event, and POSTing to record
+// every song in the event's setlists as performed at the event. Songs already recorded for the event are skipped.
+func EventPerformancesHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Event Performances handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	eventID, err := strconv.ParseInt(mux.Vars(r)["event_id"], 10, 64)
+	if err != nil {
+		log.Printf("Event Performances handler - Unable to parse event id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	// Verify Event ID
+	var eventName string
+	if err = db.QueryRow("SELECT name FROM events WHERE event_id = $1 AND collection_id = $2", eventID, collectionID).Scan(&eventName); err != nil {
+		if err == sql.ErrNoRows {
+			SendError(w, `{"error": "Event not found."}`, http.StatusNotFound)
+		} else {
+			log.Printf("Event Performances handler - Unable to get event from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if r.Method == "POST" {
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Event Performances POST - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec(`
+			INSERT INTO song_performances(song_id, date, event_id)
+			SELECT DISTINCT ss.song_id, e.start_time::date, e.event_id
+			FROM events AS e
+			JOIN event_setlists AS es ON es.event_id = e.event_id
+			JOIN setlist_songs AS ss ON ss.setlist_id = es.setlist_id
+			WHERE e.event_id = $1 AND ss.song_id IS NOT NULL
+			  AND NOT EXISTS (SELECT 1 FROM song_performances AS p WHERE p.song_id = ss.song_id AND p.event_id = e.event_id)`, eventID); err != nil {
+			log.Printf("Event Performances POST - Unable to insert performances in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Event Performances POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec(`
+			UPDATE songs SET last_performed = GREATEST(songs.last_performed, p.date)
+			FROM song_performances AS p
+			WHERE p.song_id = songs.song_id AND p.event_id = $1`, eventID); err != nil {
+			log.Printf("Event Performances POST - Unable to update last performed dates: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Event Performances POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Event Performances POST - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+	} else if r.Method != "GET" {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT p.performance_id, p.song_id, s.name, p.date, COALESCE(p.notes, '')
+		FROM song_performances AS p
+		JOIN songs AS s ON s.song_id = p.song_id
+		WHERE p.event_id = $1
+		ORDER BY s.name`, eventID)
+	if err != nil {
+		log.Printf("Event Performances %s - Unable to retrieve performances from database: %v\n", r.Method, err)
+		SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Retrieve rows from database
+	performances := make([]Performance, 0)
+	for rows.Next() {
+		performance := Performance{EventID: &eventID, Event: eventName}
+		if err := rows.Scan(&performance.PerformanceID, &performance.SongID, &performance.Song, &performance.Date, &performance.Notes); err != nil {
+			log.Printf("Event Performances %s - Unable to retrieve row from database result: %v\n", r.Method, err)
+			continue
+		}
+		performances = append(performances, performance)
+	}
+
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		log.Printf("Event Performances %s - Unable to get performances from database result: %v\n", r.Method, err)
+		SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Send response
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(performances)
+}
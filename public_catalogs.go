@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dchest/uniuri"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Song fields that can be shown in a public catalog. Song names are always shown,
+// and notes and locations are never shown.
+var catalogFields = map[string]bool{
+	"composer": true,
+	"arranger": true,
+	"key":      true,
+	"voicing":  true,
+	"duration": true,
+	"tags":     true,
+}
+
+// Limits for catalog pages
+const (
+	defaultCatalogPageSize = 25
+	maxCatalogPageSize     = 100
+)
+
+// catalogSongsQuery finds the songs in collection $1 matching the search $2, escaped for LIKE as $3.
+// $4 and $5 say whether composers and tags are shown, and can be searched.
+const catalogSongsQuery = `
+	SELECT s.name, COALESCE(s.artist, ''), COALESCE(s.arranger, ''), COALESCE(s.key, ''), COALESCE(s.voicing, ''), s.duration,
+	       COALESCE(array_agg(t.name ORDER BY t.name) FILTER (WHERE t.tag_id IS NOT NULL), '{}')
+	FROM songs AS s
+	LEFT JOIN tagged_songs AS ts ON ts.song_id = s.song_id
+	LEFT JOIN tags AS t ON t.tag_id = ts.tag_id
+	WHERE s.collection_id = $1
+	GROUP BY s.song_id
+	HAVING $2::text = ''
+	    OR s.name ILIKE '%' || $3 || '%'
+	    OR ($4 AND s.artist ILIKE '%' || $3 || '%')
+	    OR ($5 AND COALESCE(bool_or(t.name ILIKE '%' || $3 || '%'), false))`
+
+// CollectionCatalog is a struct that models the public catalog settings of a collection, both in the request body, and in the DB
+type CollectionCatalog struct {
+	Public    bool     `json:"public"`
+	ShareCode *string  `json:"share_code,omitempty"`
+	Fields    []string `json:"fields"`
+}
+
+// PublicCatalog is a struct that models the public structure of a collection
+type PublicCatalog struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Fields      []string `json:"fields"`
+}
+
+// PublicCatalogSong is a struct that models the public structure of a song in a catalog.
+// Only the fields chosen by the collection admins are included.
+type PublicCatalogSong struct {
+	Name     string   `json:"name"`
+	Composer string   `json:"composer,omitempty"`
+	Arranger string   `json:"arranger,omitempty"`
+	Key      string   `json:"key,omitempty"`
+	Voicing  string   `json:"voicing,omitempty"`
+	Duration *int64   `json:"duration,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// PublicCatalogPage is a page of songs in a public catalog
+type PublicCatalogPage struct {
+	Songs []PublicCatalogSong `json:"songs"`
+	Page  int                 `json:"page"`
+	Pages int                 `json:"pages"`
+	Total int                 `json:"total"`
+}
+
+// CollectionCatalogHandler handles GETting and updating whether a collection's catalog is public, and which fields it shows.
+// Only collection admins can change the catalog.
+func CollectionCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Collection Catalog handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Collection Catalog handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		var catalog CollectionCatalog
+		if err = db.QueryRow("SELECT catalog_share_code, catalog_fields FROM collections WHERE collection_id = $1", collectionID).Scan(&catalog.ShareCode, pq.Array(&catalog.Fields)); err != nil {
+			log.Printf("Collection Catalog GET - Unable to get catalog from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		catalog.Public = catalog.ShareCode != nil
+		if catalog.Fields == nil {
+			catalog.Fields = make([]string, 0)
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(catalog)
+		return
+
+	} else if r.Method == "PUT" {
+		// Verify user is admin of collection
+		if admin, err := checkAdmin(session.Values["user_id"].(int64), collectionID); err != nil {
+			log.Printf("Collection Catalog PUT - Unable to check admin status for user %d in collection %d: %v\n", session.Values["user_id"], collectionID, err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if !admin {
+			log.Printf("Collection Catalog PUT - Non-admin user %d attempted to share collection %d\n", session.Values["user_id"], collectionID)
+			SendError(w, PERMISSION_ERROR_MESSAGE, http.StatusForbidden)
+			return
+		}
+
+		var catalog CollectionCatalog
+		if err := json.NewDecoder(r.Body).Decode(&catalog); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Collection Catalog PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		fields := make([]string, 0)
+		for _, field := range catalog.Fields {
+			field = strings.ToLower(strings.TrimSpace(field))
+			if !catalogFields[field] {
+				SendError(w, `{"error": "Catalogs can only show the composer, arranger, key, voicing, duration and tags of songs."}`, http.StatusBadRequest)
+				return
+			}
+			fields = append(fields, field)
+		}
+		catalog.Fields = fields
+
+		// Keep the current share code so links that were already given out keep working
+		if catalog.Public {
+			if err = db.QueryRow("UPDATE collections SET catalog_share_code = COALESCE(catalog_share_code, $1), catalog_fields = $2 WHERE collection_id = $3 RETURNING catalog_share_code",
+				uniuri.New(), pq.Array(catalog.Fields), collectionID).Scan(&catalog.ShareCode); err != nil {
+				log.Printf("Collection Catalog PUT - Unable to update catalog in database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+		} else if _, err = db.Exec("UPDATE collections SET catalog_share_code = NULL, catalog_fields = $1 WHERE collection_id = $2", pq.Array(catalog.Fields), collectionID); err != nil {
+			log.Printf("Collection Catalog PUT - Unable to update catalog in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(catalog)
+		return
+	}
+}
+
+// PublicCatalogHandler handles getting the public version of a collection
+func PublicCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	shareCode := mux.Vars(r)["share_code"]
+
+	if r.Method == "GET" {
+		var catalog PublicCatalog
+		if err := db.QueryRow("SELECT name, COALESCE(description, ''), catalog_fields FROM collections WHERE catalog_share_code = $1", shareCode).Scan(&catalog.Name, &catalog.Description, pq.Array(&catalog.Fields)); err != nil {
+			if err == sql.ErrNoRows {
+				log.Printf("Public Catalog GET - No collection found with share code '%v'\n", shareCode)
+				SendError(w, `{"error": "Catalog not found"}`, http.StatusNotFound)
+				return
+			}
+			log.Printf("Public Catalog GET - Unable to get collection from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		if catalog.Fields == nil {
+			catalog.Fields = make([]string, 0)
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(catalog)
+		return
+	}
+}
+
+// PublicCatalogSongsHandler handles returning a page of songs from a public catalog.
+// Songs can be searched by name, and by composer and tags if the catalog shows them.
+func PublicCatalogSongsHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	shareCode := mux.Vars(r)["share_code"]
+
+	if r.Method == "GET" {
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+
+		limit := defaultCatalogPageSize
+		if limitParameter := r.URL.Query().Get("limit"); limitParameter != "" {
+			if limit, err = strconv.Atoi(limitParameter); err != nil || limit < 1 || limit > maxCatalogPageSize {
+				log.Printf("Public Catalog Songs GET - Invalid limit '%v'\n", limitParameter)
+				SendError(w, fmt.Sprintf(`{"error": "Limit must be a number between 1 and %d."}`, maxCatalogPageSize), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var collectionID int64
+		var fields []string
+		if err = db.QueryRow("SELECT collection_id, catalog_fields FROM collections WHERE catalog_share_code = $1", shareCode).Scan(&collectionID, pq.Array(&fields)); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Catalog not found"}`, http.StatusNotFound)
+				return
+			}
+			log.Printf("Public Catalog Songs GET - Unable to get collection from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		shown := make(map[string]bool)
+		for _, field := range fields {
+			shown[field] = true
+		}
+
+		// Only search the fields visitors can see
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		result := PublicCatalogPage{Songs: make([]PublicCatalogSong, 0), Page: page}
+		if err = db.QueryRow("SELECT count(*) FROM ("+catalogSongsQuery+") AS matches", collectionID, query, escapeLike(query), shown["composer"], shown["tags"]).Scan(&result.Total); err != nil {
+			log.Printf("Public Catalog Songs GET - Unable to count songs in catalog %v: %v\n", shareCode, err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		result.Pages = (result.Total + limit - 1) / limit
+
+		rows, err := db.Query(catalogSongsQuery+" ORDER BY s.name, s.song_id LIMIT $6 OFFSET $7", collectionID, query, escapeLike(query), shown["composer"], shown["tags"], limit, (page-1)*limit)
+		if err != nil {
+			log.Printf("Public Catalog Songs GET - Unable to get songs in catalog %v from database: %v\n", shareCode, err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// Retrieve rows from database, leaving out the fields that aren't shown
+		for rows.Next() {
+			var song PublicCatalogSong
+			if err := rows.Scan(&song.Name, &song.Composer, &song.Arranger, &song.Key, &song.Voicing, &song.Duration, pq.Array(&song.Tags)); err != nil {
+				log.Printf("Public Catalog Songs GET - Unable to retrieve row from database result: %v\n", err)
+				continue
+			}
+			if !shown["composer"] {
+				song.Composer = ""
+			}
+			if !shown["arranger"] {
+				song.Arranger = ""
+			}
+			if !shown["key"] {
+				song.Key = ""
+			}
+			if !shown["voicing"] {
+				song.Voicing = ""
+			}
+			if !shown["duration"] {
+				song.Duration = nil
+			}
+			if !shown["tags"] {
+				song.Tags = nil
+			}
+			result.Songs = append(result.Songs, song)
+		}
+
+		// Check for errors from iterating over rows.
+		if err := rows.Err(); err != nil {
+			log.Printf("Public Catalog Songs GET - Unable to get songs from database result: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+}
@@ -18,10 +18,21 @@ type PublicSetlist struct {
 	ShareCode *string    `json:"share_code,omitempty"`
 }
 
-// PublicSong is a struct that models the public structure of a song
+// PublicSong is a struct that models the public structure of a song.
+// The performance details are only included if the setlist owner chose to show them.
 type PublicSong struct {
-	Name  string `json:"name" db:"name"`
-	Order int64  `json:"order,omitempty" db:"order"`
+	Name        string   `json:"name" db:"name"`
+	Order       int64    `json:"order,omitempty" db:"order"`
+	Notes       string   `json:"notes,omitempty"`
+	Key         string   `json:"key,omitempty"`
+	Instruction string   `json:"instruction,omitempty"`
+	Performers  []string `json:"performers,omitempty"`
+}
+
+// PublicSetlistSection is a struct that models the public structure of a setlist section
+type PublicSetlistSection struct {
+	Name  string       `json:"name"`
+	Items []PublicSong `json:"items"`
 }
 
 // PublicSetlistHandler handles getting the public version of a setlist
@@ -39,8 +50,8 @@ func PublicSetlistHandler(w http.ResponseWriter, r *http.Request) {
 	// }
 
 	if r.Method == "GET" {
-		// Find the setlist in the database
-		if err := db.QueryRow("SELECT name, date, notes FROM setlists WHERE share_code = $1 AND shared = true", shareCode).Scan(&setlist.Name, &setlist.Date, &setlist.Notes); err != nil {
+		// Find the setlist in the database, and count the view
+		if err := db.QueryRow("UPDATE setlists SET views = views + 1, last_accessed = now() WHERE share_code = $1 AND shared = true RETURNING name, date, notes", shareCode).Scan(&setlist.Name, &setlist.Date, &setlist.Notes); err != nil {
 			if err == sql.ErrNoRows {
 				log.Printf("Public Setlist GET - No setlist found with share code '%v'\n", shareCode)
 				SendError(w, `{"error": "Setlist not found"}`, http.StatusNotFound)
@@ -60,6 +71,63 @@ func PublicSetlistHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// PublicSetlistUnlockHandler handles POSTing the password of a protected share link.
+// The session remembers the link is unlocked until its password changes.
+func PublicSetlistUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := getSession(r)
+	if err != nil {
+		log.Printf("Public Setlist Unlock handler - Unable to get session: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	shareCode := mux.Vars(r)["share_code"]
+
+	if r.Method == "POST" {
+		var request ShareLink
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Password == nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Public Setlist Unlock POST - Unable to decode request body: %v\n", err)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		var expired bool
+		var passwordHash *string
+		if err := db.QueryRow("SELECT COALESCE(share_expires < now(), false), share_password FROM setlists WHERE share_code = $1 AND shared = true", shareCode).Scan(&expired, &passwordHash); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Setlist not found"}`, http.StatusNotFound)
+				return
+			}
+			log.Printf("Public Setlist Unlock POST - Unable to get setlist from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if expired {
+			SendError(w, `{"error": "This share link has expired."}`, http.StatusGone)
+			return
+		}
+
+		if passwordHash != nil && !checkPasswordHash(*request.Password, *passwordHash) {
+			log.Printf("Public Setlist Unlock POST - Incorrect password for share code '%v'\n", shareCode)
+			SendError(w, `{"error": "Incorrect password."}`, http.StatusUnauthorized)
+			return
+		}
+
+		session.Values[shareLinkSessionKey(shareCode)] = time.Now().UnixNano()
+		if err = session.Save(r, w); err != nil {
+			log.Printf("Public Setlist Unlock POST - Unable to save session: %v\n", err)
+			SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
+
 // PublicSetlistSongsHandler handles returning songs from a public setlist
 func PublicSetlistSongsHandler(w http.ResponseWriter, r *http.Request) {
 	// Get URL parameters
@@ -67,41 +135,55 @@ func PublicSetlistSongsHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		// Retrieve songs in setlist
-		rows, err := db.Query(`
-		SELECT songs.name, setlist_songs.order
-		FROM songs 
-		JOIN setlist_songs ON songs.song_id = setlist_songs.song_id
-		JOIN setlists ON setlist_songs.setlist_id = setlists.setlist_id
-		WHERE setlists.share_code = $1
-		  AND setlists.shared = true`, shareCode)
-		if err != nil {
-			log.Printf("Public Setlist Songs GET - Unable to get songs in setlist %v from database: %v\n", shareCode, err)
+		var setlistID int64
+		var publicDetails bool
+		if err := db.QueryRow("SELECT setlist_id, public_details FROM setlists WHERE share_code = $1 AND shared = true", shareCode).Scan(&setlistID, &publicDetails); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Setlist not found"}`, http.StatusNotFound)
+				return
+			}
+			log.Printf("Public Setlist Songs GET - Unable to get setlist from database: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		// Retrieve rows from database
-		songs := make([]PublicSong, 0)
-		for rows.Next() {
-			var song PublicSong
-			if err := rows.Scan(&song.Name, &song.Order); err != nil {
-				log.Printf("Public Setlist Songs GET - Unable to get song data from database result: %v\n", err)
-			}
-			songs = append(songs, song)
+
+		items, err := getSetlistItems(setlistID)
+		if err != nil {
+			log.Printf("Public Setlist Songs GET - Unable to get items in setlist %v from database: %v\n", shareCode, err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
 		}
 
-		// Check for errors from iterating over rows.
-		if err := rows.Err(); err != nil {
-			log.Printf("Public Setlist Songs GET - Unable to get songs from database: %v\n", err)
+		// Group the items by section, leaving out private details
+		sections, err := getSetlistSections(setlistID)
+		if err != nil {
+			log.Printf("Public Setlist Songs GET - Unable to get sections from database: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 
+		publicSections := make([]PublicSetlistSection, 0)
+		for _, section := range groupSetlistItems(sections, items) {
+			publicSection := PublicSetlistSection{Name: section.Name, Items: make([]PublicSong, 0)}
+			for _, item := range section.Items {
+				song := PublicSong{Name: item.Name, Order: item.Order}
+				if publicDetails {
+					song.Notes = item.Notes
+					song.Key = item.Key
+					song.Instruction = item.Instruction
+					for _, performer := range item.Performers {
+						song.Performers = append(song.Performers, performer.Name)
+					}
+				}
+				publicSection.Items = append(publicSection.Items, song)
+			}
+			publicSections = append(publicSections, publicSection)
+		}
+
 		// Send response
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(songs)
+		json.NewEncoder(w).Encode(publicSections)
 		return
 
 	}
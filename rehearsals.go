@@ -0,0 +1,584 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Lowest and highest readiness a song can be rated after a rehearsal
+const (
+	minReadiness = 1
+	maxReadiness = 5
+)
+
+// Rehearsal is a struct that models a rehearsal toward an event or setlist, both in the request body, and in the DB.
+// Updating a rehearsal replaces its songs.
+type Rehearsal struct {
+	RehearsalID  int64           `json:"rehearsal_id" db:"rehearsal_id"`
+	Start        time.Time       `json:"start" db:"start_time"`
+	Notes        string          `json:"notes,omitempty" db:"notes"`
+	EventID      *int64          `json:"event_id,omitempty" db:"event_id"`
+	Event        string          `json:"event,omitempty"`
+	SetlistID    *int64          `json:"setlist_id,omitempty" db:"setlist_id"`
+	Setlist      string          `json:"setlist,omitempty"`
+	CollectionID int64           `json:"collection_id" db:"collection_id"`
+	Songs        []RehearsalSong `json:"songs"`
+}
+
+// RehearsalSong is a song worked on in a rehearsal, with the minutes planned for it
+// and how ready it was rated after the rehearsal.
+type RehearsalSong struct {
+	SongID    int64  `json:"song_id" db:"song_id"`
+	Name      string `json:"name,omitempty"`
+	Minutes   *int   `json:"minutes,omitempty" db:"minutes"`
+	Readiness *int   `json:"readiness,omitempty" db:"readiness"`
+}
+
+// EventReadiness is an upcoming event with how prepared each of its songs is
+type EventReadiness struct {
+	EventID int64          `json:"event_id"`
+	Name    string         `json:"name"`
+	Start   time.Time      `json:"start"`
+	Songs   []SongProgress `json:"songs"`
+}
+
+// SongProgress is how a song has been rehearsed. Readiness is from the most recent rehearsal that rated it.
+type SongProgress struct {
+	SongID        int64      `json:"song_id"`
+	Name          string     `json:"name"`
+	Readiness     *int       `json:"readiness"`
+	Rehearsals    int        `json:"rehearsals"`
+	Minutes       int        `json:"minutes"`
+	LastRehearsed *time.Time `json:"last_rehearsed"`
+}
+
+// RehearsalsHandler handles GETting all rehearsals or POSTing a new rehearsal.
+// Rehearsals can be filtered with ?event_id= or ?setlist_id=.
+func RehearsalsHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Rehearsals handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Rehearsals handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		// Get optional filters
+		var eventID, setlistID int64
+		if value := r.URL.Query().Get("event_id"); value != "" {
+			if eventID, err = strconv.ParseInt(value, 10, 64); err != nil {
+				log.Printf("Rehearsals GET - Unable to parse event id from URL: %v\n", err)
+				SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+				return
+			}
+		}
+		if value := r.URL.Query().Get("setlist_id"); value != "" {
+			if setlistID, err = strconv.ParseInt(value, 10, 64); err != nil {
+				log.Printf("Rehearsals GET - Unable to parse setlist id from URL: %v\n", err)
+				SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+				return
+			}
+		}
+
+		rehearsals, err := getRehearsals(collectionID, 0, eventID, setlistID, session.Values["user_id"].(int64))
+		if err != nil {
+			log.Printf("Rehearsals GET - Unable to retrieve rehearsals from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rehearsals)
+		return
+
+	} else if r.Method == "POST" {
+		var rehearsal Rehearsal
+		if err := json.NewDecoder(r.Body).Decode(&rehearsal); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Rehearsals POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		rehearsal.CollectionID = collectionID
+		if message, err := checkRehearsal(&rehearsal, nil, session.Values["user_id"].(int64)); err != nil {
+			log.Printf("Rehearsals POST - Unable to check rehearsal: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Rehearsals POST - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Create rehearsal in database
+		if err = tx.QueryRow("INSERT INTO rehearsals(start_time, notes, event_id, setlist_id, collection_id) VALUES ($1, $2, $3, $4, $5) RETURNING rehearsal_id",
+			rehearsal.Start, rehearsal.Notes, rehearsal.EventID, rehearsal.SetlistID, collectionID).Scan(&rehearsal.RehearsalID); err != nil {
+			log.Printf("Rehearsals POST - Unable to insert rehearsal in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Rehearsals POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = insertRehearsalSongs(tx, rehearsal.RehearsalID, rehearsal.Songs); err != nil {
+			log.Printf("Rehearsals POST - Unable to add songs to rehearsal: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Rehearsals POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Rehearsals POST - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rehearsal)
+		return
+	}
+}
+
+// RehearsalHandler handles GETting, updating, or deleting a single rehearsal.
+// Readiness ratings are recorded by updating the rehearsal after it has happened.
+func RehearsalHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Rehearsal handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Rehearsal handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	rehearsalID, err := strconv.ParseInt(mux.Vars(r)["rehearsal_id"], 10, 64)
+	if err != nil {
+		log.Printf("Rehearsal handler - Unable to parse rehearsal id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		rehearsals, err := getRehearsals(collectionID, rehearsalID, 0, 0, session.Values["user_id"].(int64))
+		if err != nil {
+			log.Printf("Rehearsal GET - Unable to get rehearsal from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if len(rehearsals) == 0 {
+			SendError(w, `{"error": "Rehearsal not found."}`, http.StatusNotFound)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rehearsals[0])
+		return
+
+	} else if r.Method == "PUT" {
+		var rehearsal Rehearsal
+		if err := json.NewDecoder(r.Body).Decode(&rehearsal); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Rehearsal PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Use the URL IDs so the user can't update another record
+		rehearsal.RehearsalID = rehearsalID
+		rehearsal.CollectionID = collectionID
+
+		// Keep the stored setlist if the user can't see it
+		var storedSetlistID *int64
+		var setlistVisible bool
+		if err := db.QueryRow(`
+			SELECT r.setlist_id,
+			       r.setlist_id IS NULL OR r.setlist_id IN (SELECT setlist_id FROM setlists
+			                                                WHERE user_id = $3 OR shared OR setlist_id IN (SELECT setlist_id FROM setlist_collaborators WHERE user_id = $3))
+			FROM rehearsals AS r
+			WHERE r.rehearsal_id = $1 AND r.collection_id = $2`,
+			rehearsalID, collectionID, session.Values["user_id"].(int64)).Scan(&storedSetlistID, &setlistVisible); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Rehearsal not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Rehearsal PUT - Unable to get rehearsal from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if !setlistVisible {
+			rehearsal.SetlistID = storedSetlistID
+		}
+
+		// Input validation
+		if message, err := checkRehearsal(&rehearsal, storedSetlistID, session.Values["user_id"].(int64)); err != nil {
+			log.Printf("Rehearsal PUT - Unable to check rehearsal: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Rehearsal PUT - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Update rehearsal in database
+		result, err := tx.Exec("UPDATE rehearsals SET start_time = $1, notes = $2, event_id = $3, setlist_id = $4 WHERE rehearsal_id = $5 AND collection_id = $6",
+			rehearsal.Start, rehearsal.Notes, rehearsal.EventID, rehearsal.SetlistID, rehearsalID, collectionID)
+		if err != nil {
+			log.Printf("Rehearsal PUT - Unable to update rehearsal in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Rehearsal PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Check if update did anything
+		if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Rehearsal PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			if err != nil {
+				log.Printf("Rehearsal PUT - Database update unsuccessful: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			} else {
+				SendError(w, `{"error": "Rehearsal not found."}`, http.StatusNotFound)
+			}
+			return
+		}
+
+		// Replace the rehearsal's songs
+		if _, err = tx.Exec("DELETE FROM rehearsal_songs WHERE rehearsal_id = $1", rehearsalID); err != nil {
+			log.Printf("Rehearsal PUT - Unable to remove songs from rehearsal: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Rehearsal PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = insertRehearsalSongs(tx, rehearsalID, rehearsal.Songs); err != nil {
+			log.Printf("Rehearsal PUT - Unable to add songs to rehearsal: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Rehearsal PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Rehearsal PUT - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+
+	} else if r.Method == "DELETE" {
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Rehearsal DELETE - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("DELETE FROM rehearsal_songs WHERE rehearsal_id IN (SELECT rehearsal_id FROM rehearsals WHERE rehearsal_id = $1 AND collection_id = $2)", rehearsalID, collectionID); err != nil {
+			log.Printf("Rehearsal DELETE - Unable to remove songs from rehearsal: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Rehearsal DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("DELETE FROM rehearsals WHERE rehearsal_id = $1 AND collection_id = $2", rehearsalID, collectionID); err != nil {
+			log.Printf("Rehearsal DELETE - Unable to delete rehearsal from database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Rehearsal DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Rehearsal DELETE - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
+
+// RehearsalReadinessHandler handles GETting each upcoming event with the songs in its setlists,
+// their latest readiness rating, and how many times and minutes they have been rehearsed.
+// Only rehearsals that have already started are counted.
+func RehearsalReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Rehearsal Readiness handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Rehearsal Readiness handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		// Only the setlists the user can see are included
+		events, err := getEvents(collectionID, 0, true, session.Values["user_id"].(int64))
+		if err != nil {
+			log.Printf("Rehearsal Readiness GET - Unable to get upcoming events from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		readiness := make([]EventReadiness, 0, len(events))
+		for _, event := range events {
+			songs, err := getSongProgress(collectionID, event.SetlistIDs)
+			if err != nil {
+				log.Printf("Rehearsal Readiness GET - Unable to get song progress for event %d: %v\n", event.EventID, err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+			readiness = append(readiness, EventReadiness{EventID: event.EventID, Name: event.Name, Start: event.Start, Songs: songs})
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(readiness)
+		return
+	}
+}
+
+// getRehearsals gets the rehearsals in a collection, most recent first, with their songs.
+// Use 0 for rehearsalID, eventID or setlistID to not filter by them.
+// The setlist name is only included if the user can see the setlist.
+func getRehearsals(collectionID, rehearsalID, eventID, setlistID, userID int64) ([]Rehearsal, error) {
+	rows, err := db.Query(`
+		SELECT r.rehearsal_id, r.start_time, COALESCE(r.notes, ''), r.event_id, COALESCE(e.name, ''), r.setlist_id, COALESCE(s.name, '')
+		FROM rehearsals AS r
+		LEFT JOIN events AS e ON e.event_id = r.event_id
+		LEFT JOIN setlists AS s ON s.setlist_id = r.setlist_id
+		  AND (s.user_id = $5 OR s.shared OR s.setlist_id IN (SELECT setlist_id FROM setlist_collaborators WHERE user_id = $5))
+		WHERE r.collection_id = $1
+		  AND ($2 = 0 OR r.rehearsal_id = $2)
+		  AND ($3 = 0 OR r.event_id = $3)
+		  AND ($4 = 0 OR r.setlist_id = $4)
+		ORDER BY r.start_time DESC, r.rehearsal_id DESC`, collectionID, rehearsalID, eventID, setlistID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rehearsals := make([]Rehearsal, 0)
+	rehearsalIDs := make([]int64, 0)
+	for rows.Next() {
+		rehearsal := Rehearsal{CollectionID: collectionID, Songs: make([]RehearsalSong, 0)}
+		if err := rows.Scan(&rehearsal.RehearsalID, &rehearsal.Start, &rehearsal.Notes, &rehearsal.EventID, &rehearsal.Event, &rehearsal.SetlistID, &rehearsal.Setlist); err != nil {
+			return nil, err
+		}
+		rehearsals = append(rehearsals, rehearsal)
+		rehearsalIDs = append(rehearsalIDs, rehearsal.RehearsalID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Add songs in the order they were planned
+	songRows, err := db.Query(`
+		SELECT rs.rehearsal_id, rs.song_id, songs.name, rs.minutes, rs.readiness
+		FROM rehearsal_songs AS rs
+		JOIN songs ON songs.song_id = rs.song_id
+		WHERE rs.rehearsal_id = ANY($1)
+		ORDER BY rs.rehearsal_id, rs."order"`, pq.Array(rehearsalIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer songRows.Close()
+
+	positions := make(map[int64]int)
+	for i, rehearsal := range rehearsals {
+		positions[rehearsal.RehearsalID] = i
+	}
+	for songRows.Next() {
+		var rehearsalID int64
+		var song RehearsalSong
+		if err := songRows.Scan(&rehearsalID, &song.SongID, &song.Name, &song.Minutes, &song.Readiness); err != nil {
+			return nil, err
+		}
+		rehearsal := &rehearsals[positions[rehearsalID]]
+		rehearsal.Songs = append(rehearsal.Songs, song)
+	}
+
+	return rehearsals, songRows.Err()
+}
+
+// getSongProgress gets how each song in the setlists has been rehearsed, least ready first.
+// Songs that have never been rated come before all rated songs.
+func getSongProgress(collectionID int64, setlistIDs []int64) ([]SongProgress, error) {
+	rows, err := db.Query(`
+		SELECT songs.song_id, songs.name,
+		       (SELECT rs.readiness FROM rehearsal_songs AS rs JOIN rehearsals AS r ON r.rehearsal_id = rs.rehearsal_id
+		        WHERE rs.song_id = songs.song_id AND rs.readiness IS NOT NULL AND r.start_time <= now()
+		        ORDER BY r.start_time DESC, r.rehearsal_id DESC LIMIT 1) AS readiness,
+		       count(r.rehearsal_id), COALESCE(sum(rs.minutes) FILTER (WHERE r.rehearsal_id IS NOT NULL), 0), max(r.start_time)
+		FROM songs
+		LEFT JOIN rehearsal_songs AS rs ON rs.song_id = songs.song_id
+		LEFT JOIN rehearsals AS r ON r.rehearsal_id = rs.rehearsal_id AND r.start_time <= now()
+		WHERE songs.collection_id = $1
+		  AND songs.song_id IN (SELECT song_id FROM setlist_songs WHERE setlist_id = ANY($2))
+		GROUP BY songs.song_id, songs.name
+		ORDER BY readiness NULLS FIRST, songs.name`, collectionID, pq.Array(setlistIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	songs := make([]SongProgress, 0)
+	for rows.Next() {
+		var song SongProgress
+		if err := rows.Scan(&song.SongID, &song.Name, &song.Readiness, &song.Rehearsals, &song.Minutes, &song.LastRehearsed); err != nil {
+			return nil, err
+		}
+		songs = append(songs, song)
+	}
+
+	return songs, rows.Err()
+}
+
+// checkRehearsal verifies a rehearsal's event, setlist and songs. It returns an error message
+// for the client if they are not allowed. A new setlist must be visible to the user, while
+// storedSetlistID, the setlist the rehearsal already has, is always allowed.
+func checkRehearsal(rehearsal *Rehearsal, storedSetlistID *int64, userID int64) (string, error) {
+	if rehearsal.Start.IsZero() {
+		return `{"error": "No rehearsal start time supplied."}`, nil
+	}
+
+	if rehearsal.EventID == nil && rehearsal.SetlistID == nil {
+		return `{"error": "A rehearsal must be for an event or a setlist."}`, nil
+	}
+
+	if rehearsal.EventID != nil {
+		var events int
+		if err := db.QueryRow("SELECT count(*) FROM events WHERE event_id = $1 AND collection_id = $2", *rehearsal.EventID, rehearsal.CollectionID).Scan(&events); err != nil {
+			return "", err
+		} else if events == 0 {
+			return `{"error": "Event not found."}`, nil
+		}
+	}
+
+	if rehearsal.SetlistID != nil && (storedSetlistID == nil || *rehearsal.SetlistID != *storedSetlistID) {
+		var setlists int
+		if err := db.QueryRow(`
+			SELECT count(*) FROM setlists
+			WHERE setlist_id = $1 AND collection_id = $2
+			  AND (user_id = $3 OR shared OR setlist_id IN (SELECT setlist_id FROM setlist_collaborators WHERE user_id = $3))`,
+			*rehearsal.SetlistID, rehearsal.CollectionID, userID).Scan(&setlists); err != nil {
+			return "", err
+		} else if setlists == 0 {
+			return `{"error": "Setlist not found."}`, nil
+		}
+	}
+
+	if rehearsal.Songs == nil {
+		rehearsal.Songs = make([]RehearsalSong, 0)
+	}
+
+	songIDs := make([]int64, 0, len(rehearsal.Songs))
+	for _, song := range rehearsal.Songs {
+		if song.Minutes != nil && *song.Minutes < 0 {
+			return `{"error": "Minutes can't be negative."}`, nil
+		}
+		if song.Readiness != nil && (*song.Readiness < minReadiness || *song.Readiness > maxReadiness) {
+			return `{"error": "Readiness must be from 1 to 5."}`, nil
+		}
+		songIDs = append(songIDs, song.SongID)
+	}
+
+	if len(uniqueIDs(songIDs)) != len(songIDs) {
+		return `{"error": "A song can only be in a rehearsal once."}`, nil
+	}
+
+	if len(songIDs) > 0 {
+		var songs int
+		if err := db.QueryRow("SELECT count(*) FROM songs WHERE song_id = ANY($1) AND collection_id = $2", pq.Array(songIDs), rehearsal.CollectionID).Scan(&songs); err != nil {
+			return "", err
+		} else if songs != len(songIDs) {
+			return `{"error": "Song not found."}`, nil
+		}
+	}
+
+	return "", nil
+}
+
+// insertRehearsalSongs adds songs to a rehearsal in the order given
+func insertRehearsalSongs(tx *sql.Tx, rehearsalID int64, songs []RehearsalSong) error {
+	for i, song := range songs {
+		if _, err := tx.Exec(`INSERT INTO rehearsal_songs(rehearsal_id, song_id, minutes, readiness, "order") VALUES ($1, $2, $3, $4, $5)`,
+			rehearsalID, song.SongID, song.Minutes, song.Readiness, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// SavedSearch is a struct that models an advanced search saved under a name, both in the request body, and in the DB
+type SavedSearch struct {
+	SavedSearchID int64                 `json:"saved_search_id" db:"saved_search_id"`
+	Name          string                `json:"name" db:"name"`
+	Search        AdvancedSearchRequest `json:"search" db:"search"`
+	Shared        bool                  `json:"shared" db:"shared"`
+	UserID        int64                 `json:"user_id" db:"user_id"`
+	CollectionID  int64                 `json:"collection_id" db:"collection_id"`
+}
+
+// SavedSearchesHandler handles GETting all saved searches visible to the user and POSTing a new saved search.
+func SavedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Saved Searches handler - Unable to get session: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Saved Searches handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		searches, err := getSavedSearches(collectionID, session.Values["user_id"].(int64))
+		if err != nil {
+			log.Printf("Saved Searches GET - Unable to retrieve saved searches from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(searches)
+		return
+
+	} else if r.Method == "POST" {
+		// Parse and decode the request body into a new `SavedSearch` instance
+		var search SavedSearch
+		if err := json.NewDecoder(r.Body).Decode(&search); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Saved Searches POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if search.Name == "" {
+			log.Println("Saved Searches POST - Cannot save a search with a blank name.")
+			SendError(w, `{"error": "Cannot save a search with a blank name."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Saved searches always run in the collection they were saved in
+		search.Search.CollectionID = collectionID
+		encodedSearch, err := json.Marshal(search.Search)
+		if err != nil {
+			log.Printf("Saved Searches POST - Unable to encode search: %v\n", err)
+			SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Create saved search in database
+		if err = db.QueryRow("INSERT INTO saved_searches(name, search, shared, user_id, collection_id) VALUES ($1, $2, $3, $4, $5) RETURNING saved_search_id",
+			search.Name, encodedSearch, search.Shared, session.Values["user_id"], collectionID).Scan(&search.SavedSearchID); err != nil {
+			log.Printf("Saved Searches POST - Unable to insert saved search into database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			SavedSearchID int64 `json:"saved_search_id"`
+		}{
+			search.SavedSearchID,
+		})
+	}
+}
+
+// SavedSearchHandler handles getting, updating, and deleting a single saved search.
+func SavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Saved Search handler - Unable to get session: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Saved Search handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	savedSearchID, err := strconv.ParseInt(mux.Vars(r)["saved_search_id"], 10, 64)
+	if err != nil {
+		log.Printf("Saved Search handler - Unable to parse saved search id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		search, err := getSavedSearch(savedSearchID, collectionID, session.Values["user_id"].(int64))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Saved search not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Saved Search GET - Unable to get saved search from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(search)
+		return
+
+	} else if r.Method == "PUT" {
+		var search SavedSearch
+		if err := json.NewDecoder(r.Body).Decode(&search); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Saved Search PUT - Unable to parse request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if search.Name == "" {
+			log.Println("Saved Search PUT - Cannot save a search with a blank name.")
+			SendError(w, `{"error": "Cannot save a search with a blank name."}`, http.StatusBadRequest)
+			return
+		}
+
+		search.Search.CollectionID = collectionID
+		encodedSearch, err := json.Marshal(search.Search)
+		if err != nil {
+			log.Printf("Saved Search PUT - Unable to encode search: %v\n", err)
+			SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Only the owner of a saved search may change it
+		var result sql.Result
+		if result, err = db.Exec("UPDATE saved_searches SET name = $1, search = $2, shared = $3 WHERE saved_search_id = $4 AND collection_id = $5 AND user_id = $6",
+			search.Name, encodedSearch, search.Shared, savedSearchID, collectionID, session.Values["user_id"]); err != nil {
+			log.Printf("Saved Search PUT - Unable to update saved search in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			log.Printf("Saved Search PUT - Unable to get rows affected by UPDATE: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if rowsAffected == 0 {
+			log.Printf("Saved Search PUT - No saved search %d owned by user %d in collection %d.\n", savedSearchID, session.Values["user_id"], collectionID)
+			SendError(w, `{"error": "Saved search not found."}`, http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+
+	} else if r.Method == "DELETE" {
+		var result sql.Result
+		if result, err = db.Exec("DELETE FROM saved_searches WHERE saved_search_id = $1 AND collection_id = $2 AND user_id = $3", savedSearchID, collectionID, session.Values["user_id"]); err != nil {
+			log.Printf("Saved Search DELETE - Unable to delete saved search from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		var rowsAffected int64
+		if rowsAffected, err = result.RowsAffected(); err != nil {
+			log.Printf("Saved Search DELETE - Unable to get rows affected. Assuming everything is fine? Error: %v\n", err)
+		} else if rowsAffected == 0 {
+			log.Printf("Saved Search DELETE - No saved search %d owned by user %d in collection %d.\n", savedSearchID, session.Values["user_id"], collectionID)
+			SendError(w, `{"error": "Saved search not found."}`, http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
+
+// SavedSearchSongsHandler handles running a saved search
+func SavedSearchSongsHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Saved Search Songs handler - Unable to get session: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Saved Search Songs handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	savedSearchID, err := strconv.ParseInt(mux.Vars(r)["saved_search_id"], 10, 64)
+	if err != nil {
+		log.Printf("Saved Search Songs handler - Unable to parse saved search id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		search, err := getSavedSearch(savedSearchID, collectionID, session.Values["user_id"].(int64))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Saved search not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Saved Search Songs GET - Unable to get saved search from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		results, err := advancedSearch(search.Search)
+		if err != nil {
+			log.Printf("Saved Search Songs GET - Unable to run saved search %d: %v\n", savedSearchID, err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(results)
+		return
+	}
+}
+
+// getSavedSearches returns the saved searches in a collection that are visible to a user
+func getSavedSearches(collectionID, userID int64) ([]SavedSearch, error) {
+	rows, err := db.Query("SELECT saved_search_id, name, search, shared, user_id FROM saved_searches WHERE collection_id = $1 AND (user_id = $2 OR shared = true) ORDER BY name", collectionID, userID)
+	if err != nil {
+		log.Printf("getSavedSearches - Unable to retrieve saved searches from database: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Retrieve rows from database
+	searches := make([]SavedSearch, 0)
+	for rows.Next() {
+		var search SavedSearch
+		var encodedSearch []byte
+		if err := rows.Scan(&search.SavedSearchID, &search.Name, &encodedSearch, &search.Shared, &search.UserID); err != nil {
+			log.Printf("getSavedSearches - Unable to retrieve row from database result: %v\n", err)
+			continue
+		}
+		if err := json.Unmarshal(encodedSearch, &search.Search); err != nil {
+			log.Printf("getSavedSearches - Unable to decode saved search %d: %v\n", search.SavedSearchID, err)
+			continue
+		}
+		search.CollectionID = collectionID
+		searches = append(searches, search)
+	}
+
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		log.Printf("getSavedSearches - Error retrieving saved searches from database result: %v\n", err)
+		return nil, err
+	}
+
+	return searches, nil
+}
+
+// getSavedSearch returns a saved search if it is visible to a user, or sql.ErrNoRows if it is not
+func getSavedSearch(savedSearchID, collectionID, userID int64) (SavedSearch, error) {
+	var search SavedSearch
+	var encodedSearch []byte
+	if err := db.QueryRow("SELECT saved_search_id, name, search, shared, user_id, collection_id FROM saved_searches WHERE saved_search_id = $1 AND collection_id = $2 AND (user_id = $3 OR shared = true)",
+		savedSearchID, collectionID, userID).Scan(&search.SavedSearchID, &search.Name, &encodedSearch, &search.Shared, &search.UserID, &search.CollectionID); err != nil {
+		return search, err
+	}
+
+	if err := json.Unmarshal(encodedSearch, &search.Search); err != nil {
+		log.Printf("getSavedSearch - Unable to decode saved search %d: %v\n", savedSearchID, err)
+		return search, err
+	}
+
+	return search, nil
+}
+
+// savedSearchSongIDs runs saved searches and returns the IDs of songs matching any of them.
+// An empty list of saved searches returns a nil list of songs, so it doesn't filter anything.
+func savedSearchSongIDs(savedSearchIDs []int64, collectionID, userID int64) ([]int64, error) {
+	if len(savedSearchIDs) == 0 {
+		return nil, nil
+	}
+
+	songIDs := make([]int64, 0)
+	for _, savedSearchID := range savedSearchIDs {
+		search, err := getSavedSearch(savedSearchID, collectionID, userID)
+		if err != nil {
+			log.Printf("savedSearchSongIDs - Unable to get saved search %d: %v\n", savedSearchID, err)
+			return nil, err
+		}
+
+		results, err := advancedSearch(search.Search)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, result := range results {
+			songIDs = append(songIDs, result.SongID)
+		}
+	}
+
+	return songIDs, nil
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"html"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,16 +19,65 @@ import (
 
 // SearchResult is a struct that models a result from a search
 type SearchResult struct {
-	SongID   int64  `json:"song_id" db:"song_id"`
-	SongName string `json:"song_name" db:"song_name"`
+	SongID        int64      `json:"song_id" db:"song_id"`
+	CollectionID  int64      `json:"collection_id,omitempty" db:"collection_id"`
+	SongName      string     `json:"song_name" db:"song_name"`
+	Artist        string     `json:"artist,omitempty" db:"artist"`
+	Voicing       string     `json:"voicing,omitempty" db:"voicing"`
+	LastPerformed *time.Time `json:"last_performed,omitempty" db:"last_performed"`
+	Tags          []string   `json:"tags,omitempty" db:"tags"`
+	Rank          float64    `json:"rank,omitempty" db:"rank"`
+	Snippet       string     `json:"snippet,omitempty" db:"snippet"`
+	MatchedFields []string   `json:"matched_fields,omitempty" db:"matched_fields"`
 }
 
-// AdvancedSearchRequest models the POST request body of an advanced search request
+// SearchFacet is the number of search results sharing a value
+type SearchFacet struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// SearchFacets models the facet counts of a search, used for drilling down into the results
+type SearchFacets struct {
+	Tags     []SearchFacet `json:"tags"`
+	Voicings []SearchFacet `json:"voicings"`
+	Decades  []SearchFacet `json:"last_performed_decades"`
+}
+
+// SearchResponse is the data that is returned from a search
+type SearchResponse struct {
+	Results []SearchResult `json:"results"`
+	Facets  SearchFacets   `json:"facets"`
+}
+
+// CollectionSearchResults is the search results from one collection when searching all of the user's collections
+type CollectionSearchResults struct {
+	CollectionID int64          `json:"collection_id"`
+	Name         string         `json:"name"`
+	Admin        bool           `json:"admin"`
+	Results      []SearchResult `json:"results"`
+}
+
+// Snippet highlights are marked by ts_headline with these delimiters, then
+// replaced with <mark> tags after the rest of the snippet has been escaped.
+const (
+	snippetStart = "\u27e6"
+	snippetStop  = "\u27e7"
+)
+
+// AdvancedSearchRequest models the POST request body of an advanced search request.
+// Songs must have any of Tags, all of AllTags and none of ExcludeTags.
+// Before and After filter on the date last performed, and AddedBefore and AddedAfter on the date added.
+// Keywords are optional.
 type AdvancedSearchRequest struct {
 	CollectionID int64      `json:"collection_id"`
 	Tags         []int64    `json:"tags"`
+	AllTags      []int64    `json:"all_tags,omitempty"`
+	ExcludeTags  []int64    `json:"exclude_tags,omitempty"`
 	Before       *time.Time `json:"before"`
 	After        *time.Time `json:"after"`
+	AddedBefore  *time.Time `json:"added_before,omitempty"`
+	AddedAfter   *time.Time `json:"added_after,omitempty"`
 	Include      []string   `json:"include"`
 	Exclude      []string   `json:"exclude"`
 }
@@ -48,16 +99,16 @@ func SearchHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Parse the query into a SQL predicate
 		log.Printf("Raw query: '%v'\n", rawQuery)
-		var reg *regexp.Regexp
-		if reg, err = regexp.Compile("[^a-zA-Z0-9 ']+"); err != nil {
-			log.Printf("Search GET - Unable to compile search RegEx: %v\n", err)
-			SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		parsedQuery, err := parseSearchQuery(rawQuery)
+		if err != nil {
+			log.Printf("Search GET - Unable to parse search query '%v': %v\n", rawQuery, err)
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err)
 			return
 		}
-		sanitizedQuery := reg.ReplaceAllString(rawQuery, "")
-		query := strings.Join(strings.Fields(sanitizedQuery), " & ")
-		log.Printf("Processed query: '%v'\n", query)
 
 		// Get URL parameter
 		collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
@@ -67,29 +118,22 @@ func SearchHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Call the database function
-		log.Printf("Search GET - Calling database function collection_search with parameters collection_id = %v and query = %v\n", collectionID, query)
-		rows, err := db.Query("SELECT * FROM search_collection($1, $2)", collectionID, query)
-		if err != nil {
-			log.Printf("Search GET - Unable to retrieve search results from database for user %d in collection %d: %v\n", session.Values["user_id"], collectionID, err)
-			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		// Retrieve rows from database
-		results := make([]SearchResult, 0)
-		for rows.Next() {
-			var result SearchResult
-			if err := rows.Scan(&result.SongID, &result.SongName); err != nil {
-				log.Printf("Search GET - Unable to retrieve row from database result: %v\n", err)
+		// Check whether typo-tolerant matching was requested
+		var fuzzy bool
+		if fuzzyParameter := r.URL.Query().Get("fuzzy"); fuzzyParameter != "" {
+			if fuzzy, err = strconv.ParseBool(fuzzyParameter); err != nil {
+				log.Printf("Search GET - Unable to parse fuzzy parameter '%v': %v\n", fuzzyParameter, err)
+				SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+				return
 			}
-			results = append(results, result)
 		}
 
-		// Check for errors from iterating over rows.
-		if err := rows.Err(); err != nil {
-			log.Printf("Search GET - Error retrieving search results from database result: %v\n", err)
+		// Run the compiled query
+		query := compileSearchQuery(parsedQuery, 2, fuzzy)
+		log.Printf("Search GET - Searching collection %v with predicate %v\n", collectionID, query.Where)
+		results, err := searchCollections([]int64{collectionID}, query)
+		if err != nil {
+			log.Printf("Search GET - Unable to retrieve search results from database for user %d in collection %d: %v\n", session.Values["user_id"], collectionID, err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
@@ -97,7 +141,7 @@ func SearchHandler(w http.ResponseWriter, r *http.Request) {
 		// Send response
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(results)
+		json.NewEncoder(w).Encode(SearchResponse{results, buildSearchFacets(results)})
 		return
 	} else if r.Method == "POST" {
 		var search AdvancedSearchRequest
@@ -131,74 +175,388 @@ func SearchHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		var reg *regexp.Regexp
-		if reg, err = regexp.Compile("[^a-zA-Z0-9 ']+"); err != nil {
-			log.Printf("Search POST - Unable to compile search RegEx: %v\n", err)
-			SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		// Run the search
+		results, err := advancedSearch(search)
+		if err != nil {
+			log.Printf("Search POST - Unable to retrieve search results from database for user %d in collection %d: %v\n", session.Values["user_id"], search.CollectionID, err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 
-		var includedKeywords, excludedKeywords []string
-		var sanitizedKeyword string
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(SearchResponse{results, buildSearchFacets(results)})
+		return
+	}
 
-		for _, keyword := range search.Include {
-			sanitizedKeyword = reg.ReplaceAllString(keyword, "")
-			if len(sanitizedKeyword) > 0 {
-				includedKeywords = append(includedKeywords, sanitizedKeyword)
-			}
-			// log.Printf("Keyword: '%v' -> Sanitized keyword: '%v'\n", keyword, sanitizedKeyword)
+}
+
+// GlobalSearchHandler handles searching every collection the user is a member of
+func GlobalSearchHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Global Search handler - Unable to get session: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "GET" {
+		var userID = session.Values["user_id"].(int64)
+
+		// Parse the query into a SQL predicate
+		rawQuery := r.URL.Query().Get("q")
+		parsedQuery, err := parseSearchQuery(rawQuery)
+		if err != nil {
+			log.Printf("Global Search GET - Unable to parse search query '%v': %v\n", rawQuery, err)
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err)
+			return
 		}
 
-		for _, keyword := range search.Exclude {
-			sanitizedKeyword = reg.ReplaceAllString(keyword, "")
-			if len(sanitizedKeyword) > 0 {
-				excludedKeywords = append(excludedKeywords, sanitizedKeyword)
+		var fuzzy bool
+		if fuzzyParameter := r.URL.Query().Get("fuzzy"); fuzzyParameter != "" {
+			if fuzzy, err = strconv.ParseBool(fuzzyParameter); err != nil {
+				log.Printf("Global Search GET - Unable to parse fuzzy parameter '%v': %v\n", fuzzyParameter, err)
+				SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+				return
 			}
 		}
 
-		includeQuery := strings.Join(includedKeywords, " & ")
-		excludeQuery := strings.Join(excludedKeywords, " & ")
+		// Only search the collections this user is currently a member of
+		collectionIDs, err := getAuthorizedCollectionIDs(userID)
+		if err != nil {
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
 
-		// log.Printf("Collection ID: %v\n", search.CollectionID)
-		// log.Printf("Tags: %v\n", search.Tags)
-		// log.Printf("Before: %v\n", search.Before)
-		// log.Printf("After: %v\n", search.After)
-		// log.Printf("Include: %v\n", search.Include)
-		// log.Printf("Exclude: %v\n", search.Exclude)
-		// log.Printf("Include Query: %v\n", includeQuery)
-		// log.Printf("Exclude Query: %v\n", excludeQuery)
+		response := make([]CollectionSearchResults, 0)
+		if len(collectionIDs) == 0 {
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
 
-		// Call the database function
-		rows, err := db.Query("SELECT * FROM advanced_search_collection($1, $2, $3, $4, $5, $6)",
-			search.CollectionID, pq.Array(search.Tags), search.Before, search.After, includeQuery, excludeQuery)
+		// Get the user's role in each collection
+		rows, err := db.Query("SELECT collection_id, name, admin FROM collection_members NATURAL JOIN collections WHERE user_id = $1 AND collection_id = ANY($2) ORDER BY name", userID, pq.Array(collectionIDs))
 		if err != nil {
-			log.Printf("Search POST - Unable to retrieve search results from database for user %d in collection %d: %v\n", session.Values["user_id"], search.CollectionID, err)
+			log.Printf("Global Search GET - Unable to retrieve collections from database for user %d: %v\n", userID, err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 		defer rows.Close()
 
-		// Retrieve rows from database
-		results := make([]SearchResult, 0)
+		groups := make(map[int64]*CollectionSearchResults)
+		order := make([]int64, 0)
 		for rows.Next() {
-			var result SearchResult
-			if err := rows.Scan(&result.SongID, &result.SongName); err != nil {
-				log.Printf("Search POST - Unable to retrieve row from database result: %v\n", err)
+			var group CollectionSearchResults
+			var admin *bool
+			if err := rows.Scan(&group.CollectionID, &group.Name, &admin); err != nil {
+				log.Printf("Global Search GET - Unable to retrieve collection from database result: %v\n", err)
+				continue
 			}
-			results = append(results, result)
+			group.Admin = admin != nil && *admin
+			group.Results = make([]SearchResult, 0)
+			groups[group.CollectionID] = &group
+			order = append(order, group.CollectionID)
 		}
 
-		// Check for errors from iterating over rows.
 		if err := rows.Err(); err != nil {
-			log.Printf("Search GET - Error retrieving search results from database result: %v\n", err)
+			log.Printf("Global Search GET - Error retrieving collections from database result: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Run the compiled query across all of the collections
+		query := compileSearchQuery(parsedQuery, 2, fuzzy)
+		results, err := searchCollections(order, query)
+		if err != nil {
+			log.Printf("Global Search GET - Unable to retrieve search results from database for user %d: %v\n", userID, err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 
+		// Group the results by collection, keeping them in rank order
+		for _, result := range results {
+			if group, ok := groups[result.CollectionID]; ok {
+				group.Results = append(group.Results, result)
+			}
+		}
+
+		for _, collectionID := range order {
+			if len(groups[collectionID].Results) > 0 {
+				response = append(response, *groups[collectionID])
+			}
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+}
+
+// advancedSearch runs an advanced search request in the request's collection
+func advancedSearch(search AdvancedSearchRequest) ([]SearchResult, error) {
+	reg, err := regexp.Compile("[^\\p{L}\\p{N} ']+")
+	if err != nil {
+		log.Printf("advancedSearch - Unable to compile search RegEx: %v\n", err)
+		return nil, err
+	}
+
+	var includedKeywords, excludedKeywords []string
+	var sanitizedKeyword string
+
+	for _, keyword := range search.Include {
+		sanitizedKeyword = reg.ReplaceAllString(keyword, "")
+		if len(sanitizedKeyword) > 0 {
+			includedKeywords = append(includedKeywords, sanitizedKeyword)
+		}
+	}
+
+	for _, keyword := range search.Exclude {
+		sanitizedKeyword = reg.ReplaceAllString(keyword, "")
+		if len(sanitizedKeyword) > 0 {
+			excludedKeywords = append(excludedKeywords, sanitizedKeyword)
+		}
+	}
+
+	includeQuery := strings.Join(includedKeywords, " & ")
+	excludeQuery := strings.Join(excludedKeywords, " & ")
+
+	// Call the database function, and add the same song details as the search query language
+	rows, err := db.Query(`
+		SELECT a.song_id, s.collection_id, a.song_name, coalesce(s.artist, ''), coalesce(s.voicing, ''), s.last_performed, d.tags
+		FROM advanced_search_collection($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) WITH ORDINALITY AS a(song_id, song_name, position)
+		JOIN songs AS s ON s.song_id = a.song_id
+		JOIN song_documents AS d ON d.song_id = a.song_id
+		ORDER BY a.position`,
+		search.CollectionID, pq.Array(search.Tags), pq.Array(search.AllTags), pq.Array(search.ExcludeTags),
+		search.Before, search.After, search.AddedBefore, search.AddedAfter, includeQuery, excludeQuery)
+	if err != nil {
+		log.Printf("advancedSearch - Unable to search collection %d: %v\n", search.CollectionID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Retrieve rows from database
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		var result SearchResult
+		var tags pq.StringArray
+		if err := rows.Scan(&result.SongID, &result.CollectionID, &result.SongName, &result.Artist, &result.Voicing, &result.LastPerformed, &tags); err != nil {
+			log.Printf("advancedSearch - Unable to retrieve row from database result: %v\n", err)
+			continue
+		}
+		result.Tags = tags
+		results = append(results, result)
+	}
+
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		log.Printf("advancedSearch - Error retrieving search results from database result: %v\n", err)
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// searchCollections runs a compiled search query in one or more collections. The query's
+// placeholders must start at $2, since $1 is the list of collection IDs.
+func searchCollections(collectionIDs []int64, query *compiledQuery) ([]SearchResult, error) {
+	snippet := "''"
+	if query.TSQuery != "" {
+		snippet = `CASE WHEN to_tsvector(coalesce(s.notes, '')) @@ (` + query.TSQuery + `)
+			THEN ts_headline(coalesce(s.notes, ''), ` + query.TSQuery + `, 'StartSel=` + snippetStart + `, StopSel=` + snippetStop + `, MaxFragments=2, MinWords=5, MaxWords=20')
+			ELSE '' END`
+	}
+
+	rows, err := db.Query(`
+		SELECT s.song_id, s.collection_id, s.name, coalesce(s.artist, ''), coalesce(s.voicing, ''), s.last_performed, d.tags,
+		       `+query.Rank+` AS rank,
+		       `+snippet+`,
+		       `+query.Matches+`
+		FROM songs AS s
+		JOIN song_documents AS d ON d.song_id = s.song_id
+		WHERE s.collection_id = ANY($1)
+		  AND `+query.Where+`
+		ORDER BY rank DESC, s.name`, append([]interface{}{pq.Array(collectionIDs)}, query.Args...)...)
+	if err != nil {
+		log.Printf("searchCollections - Unable to search collections %v: %v\n", collectionIDs, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Retrieve rows from database
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		var result SearchResult
+		var tags, matchedFields pq.StringArray
+		if err := rows.Scan(&result.SongID, &result.CollectionID, &result.SongName, &result.Artist, &result.Voicing, &result.LastPerformed, &tags, &result.Rank, &result.Snippet, &matchedFields); err != nil {
+			log.Printf("searchCollections - Unable to retrieve row from database result: %v\n", err)
+			continue
+		}
+		result.Tags = tags
+		result.MatchedFields = uniqueStrings(matchedFields)
+		result.Snippet = highlightSnippet(result.Snippet)
+		results = append(results, result)
+	}
+
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		log.Printf("searchCollections - Error retrieving search results from database result: %v\n", err)
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// highlightSnippet escapes a ts_headline snippet and marks its highlighted words
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	return strings.NewReplacer(snippetStart, "<mark>", snippetStop, "</mark>").Replace(escaped)
+}
+
+// buildSearchFacets counts the tags, voicings and decades of last performance in a set of search results
+func buildSearchFacets(results []SearchResult) SearchFacets {
+	tags := make(map[string]int)
+	voicings := make(map[string]int)
+	decades := make(map[string]int)
+
+	for _, result := range results {
+		for _, tag := range result.Tags {
+			tags[tag]++
+		}
+
+		if result.Voicing != "" {
+			voicings[result.Voicing]++
+		}
+
+		if result.LastPerformed == nil {
+			decades["Never"]++
+		} else {
+			decades[strconv.Itoa(result.LastPerformed.Year()/10*10)+"s"]++
+		}
+	}
+
+	return SearchFacets{sortFacets(tags), sortFacets(voicings), sortFacets(decades)}
+}
+
+// sortFacets converts facet counts to a list, with the most common values first
+func sortFacets(counts map[string]int) []SearchFacet {
+	facets := make([]SearchFacet, 0, len(counts))
+	for value, count := range counts {
+		facets = append(facets, SearchFacet{value, count})
+	}
+
+	sort.Slice(facets, func(i, j int) bool {
+		if facets[i].Count != facets[j].Count {
+			return facets[i].Count > facets[j].Count
+		}
+		return facets[i].Value < facets[j].Value
+	})
+
+	return facets
+}
+
+// uniqueStrings removes duplicates from a list of strings, keeping the first occurrence
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// SongSuggestionsHandler handles autocompleting song names while the user is typing
+func SongSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Song Suggestions GET - Unable to parse collection id: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	limit := 10
+	if limitParameter := r.URL.Query().Get("limit"); limitParameter != "" {
+		if limit, err = strconv.Atoi(limitParameter); err != nil || limit < 1 || limit > 25 {
+			log.Printf("Song Suggestions GET - Invalid limit '%v'\n", limitParameter)
+			SendError(w, `{"error": "Limit must be a number between 1 and 25."}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Very short prefixes match too much to be useful
+	results := make([]SearchResult, 0)
+	prefix := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len([]rune(prefix)) < 2 {
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(results)
 		return
 	}
 
+	// The threshold is set for this transaction only, so the <% operator can use the trigram indexes
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Song Suggestions GET - Unable to start database transaction: %v\n", err)
+		SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("SELECT set_config('pg_trgm.word_similarity_threshold', $1, true)", strconv.FormatFloat(fuzzyThreshold, 'f', -1, 64)); err != nil {
+		log.Printf("Song Suggestions GET - Unable to set similarity threshold: %v\n", err)
+		SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Prefer titles starting with the prefix, then the closest trigram matches
+	rows, err := tx.Query(`
+		SELECT s.song_id, s.name
+		FROM songs AS s
+		WHERE s.collection_id = $1
+		  AND (s.name ILIKE $2 || '%'
+		       OR $3 <% s.name
+		       OR $3 <% s.artist)
+		ORDER BY s.name ILIKE $2 || '%' DESC,
+		         greatest(word_similarity($3, s.name), word_similarity($3, coalesce(s.artist, ''))) DESC,
+		         s.name
+		LIMIT $4`, collectionID, escapeLike(prefix), prefix, limit)
+	if err != nil {
+		log.Printf("Song Suggestions GET - Unable to retrieve suggestions from database for collection %d: %v\n", collectionID, err)
+		SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Retrieve rows from database
+	for rows.Next() {
+		var result SearchResult
+		if err := rows.Scan(&result.SongID, &result.SongName); err != nil {
+			log.Printf("Song Suggestions GET - Unable to retrieve row from database result: %v\n", err)
+			continue
+		}
+		results = append(results, result)
+	}
+
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		log.Printf("Song Suggestions GET - Error retrieving suggestions from database result: %v\n", err)
+		SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Send response
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
 }
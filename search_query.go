@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// QueryError is returned when a search query cannot be parsed. It is sent back
+// to the client so the user can see what was wrong with their query.
+type QueryError struct {
+	Message  string `json:"error"`
+	Position int    `json:"position"`
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s (at position %d)", e.Message, e.Position)
+}
+
+// searchFields maps the field qualifiers a user can type to the song attribute they search
+var searchFields = map[string]string{
+	"name":     "name",
+	"title":    "name",
+	"artist":   "artist",
+	"composer": "artist",
+	"location": "location",
+	"notes":    "notes",
+	"tag":      "tag",
+	"key":      "key",
+	"voicing":  "voicing",
+}
+
+type queryTokenKind int
+
+const (
+	tokenWord queryTokenKind = iota
+	tokenPhrase
+	tokenField
+	tokenNot
+	tokenOr
+	tokenOpen
+	tokenClose
+)
+
+type queryToken struct {
+	kind     queryTokenKind
+	field    string
+	value    string
+	phrase   bool
+	position int
+}
+
+// queryNode is a node in a parsed search query.
+// It is one of *queryTerm, *queryNot, *queryAnd or *queryOr.
+type queryNode interface{}
+
+type queryTerm struct {
+	field  string
+	value  string
+	phrase bool
+}
+
+type queryNot struct {
+	child queryNode
+}
+
+type queryAnd struct {
+	children []queryNode
+}
+
+type queryOr struct {
+	children []queryNode
+}
+
+func isQueryDelimiter(r rune) bool {
+	return unicode.IsSpace(r) || r == '"' || r == '(' || r == ')'
+}
+
+// tokenizeQuery splits a raw search query into tokens
+func tokenizeQuery(query string) ([]queryToken, error) {
+	runes := []rune(query)
+	tokens := make([]queryToken, 0)
+
+	// readPhrase reads a quoted phrase starting at the opening quote
+	readPhrase := func(start int) (string, int, error) {
+		for end := start + 1; end < len(runes); end++ {
+			if runes[end] == '"' {
+				return strings.TrimSpace(string(runes[start+1 : end])), end + 1, nil
+			}
+		}
+		return "", 0, &QueryError{"Missing closing quote.", start + 1}
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokenOpen, position: i + 1})
+			i++
+
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokenClose, position: i + 1})
+			i++
+
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, queryToken{kind: tokenNot, position: i + 1})
+			i++
+
+		case r == '"':
+			phrase, next, err := readPhrase(i)
+			if err != nil {
+				return nil, err
+			}
+			if phrase != "" {
+				tokens = append(tokens, queryToken{kind: tokenPhrase, value: phrase, phrase: true, position: i + 1})
+			}
+			i = next
+
+		default:
+			start := i
+			for i < len(runes) && !isQueryDelimiter(runes[i]) {
+				i++
+			}
+			word := string(runes[start:i])
+
+			if word == "OR" {
+				tokens = append(tokens, queryToken{kind: tokenOr, position: start + 1})
+				continue
+			}
+
+			// Words like 23:1 or re:joice that don't start with a field name are searched for as they are
+			colon := strings.Index(word, ":")
+			var field string
+			var ok bool
+			if colon > 0 {
+				field, ok = searchFields[strings.ToLower(word[:colon])]
+			}
+			if !ok {
+				tokens = append(tokens, queryToken{kind: tokenWord, value: word, position: start + 1})
+				continue
+			}
+
+			name := strings.ToLower(word[:colon])
+
+			token := queryToken{kind: tokenField, field: field, value: word[colon+1:], position: start + 1}
+			if token.value == "" && i < len(runes) && runes[i] == '"' {
+				phrase, next, err := readPhrase(i)
+				if err != nil {
+					return nil, err
+				}
+				token.value = phrase
+				token.phrase = true
+				i = next
+			}
+			if token.value == "" {
+				return nil, &QueryError{fmt.Sprintf("Missing value for search field '%s'.", name), start + 1}
+			}
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens, nil
+}
+
+// queryParser is a recursive descent parser for search queries. OR binds more
+// tightly than the implicit AND between terms, so `a b OR c` means `a (b OR c)`.
+// The grammar is:
+//
+//	query := or+
+//	or    := unary ("OR" unary)*
+//	unary := "-" unary | "(" query ")" | term
+type queryParser struct {
+	tokens   []queryToken
+	position int
+	length   int
+}
+
+// parseSearchQuery parses a search query such as
+// `artist:rutter tag:christmas "silent night" -latin key:F OR key:G`
+func parseSearchQuery(query string) (queryNode, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, &QueryError{"Search query is empty.", 1}
+	}
+
+	parser := queryParser{tokens: tokens, length: len([]rune(query))}
+	node, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	if token, ok := parser.peek(); ok {
+		return nil, parser.unexpected(token)
+	}
+
+	return node, nil
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.position >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.position], true
+}
+
+// unexpected builds the error for a token that cannot appear where it was found
+func (p *queryParser) unexpected(token queryToken) error {
+	switch token.kind {
+	case tokenClose:
+		return &QueryError{"Unexpected closing parenthesis.", token.position}
+	case tokenOr:
+		return &QueryError{"OR must be placed between two search terms.", token.position}
+	}
+	return &QueryError{"Expected a search term.", token.position}
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	children := make([]queryNode, 0)
+	for {
+		token, ok := p.peek()
+		if !ok || token.kind == tokenClose {
+			break
+		}
+
+		child, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+
+	if len(children) == 0 {
+		if token, ok := p.peek(); ok {
+			return nil, p.unexpected(token)
+		}
+		return nil, &QueryError{"Expected a search term.", p.length + 1}
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &queryAnd{children}, nil
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []queryNode{first}
+	for {
+		token, ok := p.peek()
+		if !ok || token.kind != tokenOr {
+			break
+		}
+		p.position++
+
+		next, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &queryOr{children}, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	token, ok := p.peek()
+	if !ok {
+		return nil, &QueryError{"Expected a search term.", p.length + 1}
+	}
+
+	switch token.kind {
+	case tokenNot:
+		p.position++
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNot{child}, nil
+
+	case tokenOpen:
+		p.position++
+		if closing, ok := p.peek(); ok && closing.kind == tokenClose {
+			return nil, &QueryError{"Parentheses must contain a search term.", token.position}
+		}
+		child, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if closing, ok := p.peek(); !ok || closing.kind != tokenClose {
+			return nil, &QueryError{"Missing closing parenthesis.", token.position}
+		}
+		p.position++
+		return child, nil
+
+	case tokenWord, tokenPhrase, tokenField:
+		p.position++
+		return &queryTerm{field: token.field, value: token.value, phrase: token.phrase}, nil
+	}
+
+	return nil, p.unexpected(token)
+}
+
+// compiledQuery is a search query translated into a SQL predicate over
+// `songs AS s` joined with `song_documents AS d`. User input is only ever
+// passed through args, never spliced into the SQL text.
+type compiledQuery struct {
+	Where string
+	Rank  string
+	Args  []interface{}
+
+	// TSQuery combines the free text terms of the query, for highlighting. It is empty if there are none.
+	TSQuery string
+
+	// Matches is a text[] expression listing the song fields that matched the query
+	Matches string
+
+	firstArg        int
+	fuzzy           bool
+	rankTerms       []string
+	similarityTerms []string
+	matchTerms      []string
+}
+
+// fuzzyThreshold is the minimum pg_trgm word similarity for a fuzzy match.
+// It is low enough to match misspellings like "Hallelujia" and partial titles.
+const fuzzyThreshold = 0.3
+
+// compileSearchQuery compiles a parsed query. firstArg is the number of the
+// first SQL placeholder available to the query. In fuzzy mode, free text and
+// name or artist terms also match by trigram similarity, and the similarity
+// is added to the full text rank. Negated terms are never fuzzy, so excluding
+// a word does not also exclude everything that looks like it.
+func compileSearchQuery(node queryNode, firstArg int, fuzzy bool) *compiledQuery {
+	c := &compiledQuery{firstArg: firstArg, fuzzy: fuzzy}
+	c.Where = c.compile(node, false)
+
+	ranks := make([]string, 0)
+	if len(c.rankTerms) > 0 {
+		c.TSQuery = strings.Join(c.rankTerms, " || ")
+		ranks = append(ranks, "ts_rank(d.document, "+c.TSQuery+")")
+	}
+	ranks = append(ranks, c.similarityTerms...)
+
+	if len(ranks) > 0 {
+		c.Rank = strings.Join(ranks, " + ")
+	} else {
+		c.Rank = "0"
+	}
+
+	if len(c.matchTerms) > 0 {
+		c.Matches = "array_remove(ARRAY[" + strings.Join(c.matchTerms, ", ") + "]::text[], NULL)"
+	} else {
+		c.Matches = "'{}'::text[]"
+	}
+
+	return c
+}
+
+// similarity returns the SQL for the trigram similarity of a placeholder to a song column
+func similarity(placeholder string, column string) string {
+	return "word_similarity(" + placeholder + ", coalesce(s." + column + ", ''))"
+}
+
+// fuzzyMatch returns the SQL condition for a placeholder being similar to a song column
+func fuzzyMatch(placeholder string, column string) string {
+	return similarity(placeholder, column) + " >= " + strconv.FormatFloat(fuzzyThreshold, 'f', -1, 64)
+}
+
+// arg adds a parameter to the query and returns its placeholder
+func (c *compiledQuery) arg(value interface{}) string {
+	c.Args = append(c.Args, value)
+	return "$" + strconv.Itoa(c.firstArg+len(c.Args)-1)
+}
+
+// match records that a song field matched when condition is true
+func (c *compiledQuery) match(field string, condition string) {
+	c.matchTerms = append(c.matchTerms, "CASE WHEN "+condition+" THEN '"+field+"' END")
+}
+
+func (c *compiledQuery) compile(node queryNode, negated bool) string {
+	switch n := node.(type) {
+	case *queryAnd:
+		parts := make([]string, len(n.children))
+		for i, child := range n.children {
+			parts[i] = c.compile(child, negated)
+		}
+		return "(" + strings.Join(parts, " AND ") + ")"
+
+	case *queryOr:
+		parts := make([]string, len(n.children))
+		for i, child := range n.children {
+			parts[i] = c.compile(child, negated)
+		}
+		return "(" + strings.Join(parts, " OR ") + ")"
+
+	case *queryNot:
+		return "NOT " + c.compile(n.child, !negated)
+
+	case *queryTerm:
+		condition := c.compileTerm(n, negated)
+		if !negated && n.field != "" {
+			field := n.field
+			if field == "tag" {
+				field = "tags"
+			}
+			c.match(field, condition)
+		}
+		return condition
+	}
+
+	return "true"
+}
+
+func (c *compiledQuery) compileTerm(term *queryTerm, negated bool) string {
+	tsquery := "plainto_tsquery"
+	if term.phrase {
+		tsquery = "phraseto_tsquery"
+	}
+
+	switch term.field {
+	case "":
+		value := c.arg(term.value)
+		query := tsquery + "(" + value + ")"
+		if negated {
+			return "d.document @@ " + query
+		}
+
+		c.rankTerms = append(c.rankTerms, query)
+		for _, field := range []string{"name", "artist", "location", "notes"} {
+			c.match(field, "to_tsvector(coalesce(s."+field+", '')) @@ "+query)
+		}
+		c.match("tags", "to_tsvector(array_to_string(d.tags, ' ')) @@ "+query)
+
+		if !c.fuzzy {
+			return "d.document @@ " + query
+		}
+
+		c.similarityTerms = append(c.similarityTerms, "greatest("+similarity(value, "name")+", "+similarity(value, "artist")+")")
+		c.match("name", fuzzyMatch(value, "name"))
+		c.match("artist", fuzzyMatch(value, "artist"))
+		return "(d.document @@ " + query + " OR " + fuzzyMatch(value, "name") + " OR " + fuzzyMatch(value, "artist") + ")"
+
+	case "name", "artist":
+		condition := "coalesce(s." + term.field + ", '') ILIKE " + c.arg("%"+escapeLike(term.value)+"%")
+		if !c.fuzzy || negated {
+			return condition
+		}
+
+		value := c.arg(term.value)
+		c.similarityTerms = append(c.similarityTerms, similarity(value, term.field))
+		return "(" + condition + " OR " + fuzzyMatch(value, term.field) + ")"
+
+	case "location":
+		return "coalesce(s.location, '') ILIKE " + c.arg("%"+escapeLike(term.value)+"%")
+
+	case "notes":
+		return "to_tsvector(coalesce(s.notes, '')) @@ " + tsquery + "(" + c.arg(term.value) + ")"
+
+	case "key", "voicing":
+		// NULL keys count as not matching, so -key:F still finds songs without a key
+		return "coalesce(lower(s." + term.field + "), '') = lower(" + c.arg(term.value) + ")"
+
+	case "tag":
+		// Tags match their descendants, so tag:seasonal finds songs tagged Advent
+		return "EXISTS (SELECT 1 FROM tagged_songs AS ts JOIN tag_ancestors AS ta ON ta.tag_id = ts.tag_id " +
+			"JOIN tags AS t ON t.tag_id = ta.ancestor_id " +
+			"WHERE ts.song_id = s.song_id AND lower(t.name) = lower(" + c.arg(term.value) + "))"
+	}
+
+	return "true"
+}
+
+// escapeLike escapes the wildcard characters of a LIKE pattern
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jung-kurt/gofpdf"
+)
+
+// Table of contents entries per page of a binder
+const binderContentsLines = 32
+
+// binderEntry is a song in the table of contents of a binder
+type binderEntry struct {
+	Item SetlistItem
+	Page int
+	Link int
+}
+
+// SetlistBinderHandler handles GETting a performance binder with the sheet music of every song in a setlist, in order.
+// Songs don't have sheet music files yet, so every song gets a placeholder page that can be swapped for its music.
+func SetlistBinderHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Binder handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Binder handler - Unable to parse setlist id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		// Find the setlist in the database
+		var program SetlistProgram
+		if err = db.QueryRow("SELECT name, date, COALESCE(notes, '') FROM setlists WHERE setlist_id = $1 AND collection_id = $2", setlistID, collectionID).Scan(&program.Name, &program.Date, &program.Notes); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Setlist Binder GET - Unable to get setlist from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if program.Sections, program.Runtime, _, err = getSetlistPlan(setlistID); err != nil {
+			log.Printf("Setlist Binder GET - Unable to get items in setlist %d from database: %v\n", setlistID, err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		var buffer bytes.Buffer
+		if err = writeSetlistBinder(&buffer, program); err != nil {
+			log.Printf("Setlist Binder GET - Unable to render PDF: %v\n", err)
+			SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		fileName := strings.TrimSpace(fileNamePattern.ReplaceAllString(program.Name, ""))
+		if fileName == "" {
+			fileName = "Setlist"
+		}
+
+		w.Header().Add("Content-Type", "application/pdf")
+		w.Header().Add("Content-Disposition", fmt.Sprintf(`inline; filename="%s Binder.pdf"`, fileName))
+		w.WriteHeader(http.StatusOK)
+		if _, err = w.Write(buffer.Bytes()); err != nil {
+			log.Printf("Setlist Binder GET - Unable to send PDF to client: %v\n", err)
+		}
+		return
+	}
+}
+
+// writeSetlistBinder writes a cover, a table of contents, and a page for each song in the setlist.
+// A song that appears more than once is only included once.
+func writeSetlistBinder(buffer *bytes.Buffer, program SetlistProgram) error {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetTitle(program.Name, true)
+	pdf.SetCreator("Sheet Music Organizer", true)
+
+	// Work out which page each song starts on. The cover is page 1, followed by the table of contents.
+	entries := make([]binderEntry, 0)
+	songPages := make(map[int64]int)
+	pages := 0
+	for _, section := range program.Sections {
+		for _, item := range section.Items {
+			if item.SongID == nil {
+				continue
+			}
+			entries = append(entries, binderEntry{Item: item})
+			if _, ok := songPages[*item.SongID]; !ok {
+				pages++
+				songPages[*item.SongID] = pages
+			}
+		}
+	}
+
+	contentsPages := (len(entries) + binderContentsLines - 1) / binderContentsLines
+	if contentsPages == 0 {
+		contentsPages = 1
+	}
+	links := make(map[int64]int)
+	for i := range entries {
+		songID := *entries[i].Item.SongID
+		entries[i].Page = 1 + contentsPages + songPages[songID]
+		if _, ok := links[songID]; !ok {
+			links[songID] = pdf.AddLink()
+		}
+		entries[i].Link = links[songID]
+	}
+
+	// Cover
+	pdf.AddPage()
+	pdf.SetY(90)
+	pdf.SetFont("Helvetica", "B", 28)
+	pdf.MultiCell(0, 14, tr(program.Name), "", "C", false)
+	if program.Date != nil {
+		pdf.SetFont("Helvetica", "", 14)
+		pdf.CellFormat(0, 10, program.Date.Format("Monday, January 2, 2006"), "", 1, "C", false, 0, "")
+	}
+	pdf.SetFont("Helvetica", "I", 12)
+	pdf.CellFormat(0, 10, fmt.Sprintf("%d songs - %s", len(songPages), formatDuration(program.Runtime)), "", 1, "C", false, 0, "")
+
+	// Table of contents
+	for i, entry := range entries {
+		if i%binderContentsLines == 0 {
+			pdf.AddPage()
+			pdf.SetFont("Helvetica", "B", 18)
+			pdf.CellFormat(0, 12, "Contents", "", 1, "L", false, 0, "")
+			pdf.Ln(2)
+		}
+		pdf.SetFont("Helvetica", "", 11)
+		pdf.CellFormat(10, 7, strconv.Itoa(i+1)+".", "", 0, "R", false, 0, "")
+		pdf.CellFormat(150, 7, " "+tr(entry.Item.Name), "", 0, "L", false, entry.Link, "")
+		pdf.CellFormat(0, 7, strconv.Itoa(entry.Page), "", 1, "R", false, entry.Link, "")
+	}
+	if len(entries) == 0 {
+		pdf.AddPage()
+		pdf.SetFont("Helvetica", "I", 12)
+		pdf.CellFormat(0, 10, "This setlist has no songs.", "", 1, "C", false, 0, "")
+	}
+
+	// Sheet music, or a placeholder for songs without files
+	for _, entry := range entries {
+		songID := *entry.Item.SongID
+		if _, ok := links[songID]; !ok {
+			continue
+		}
+		pdf.AddPage()
+		pdf.SetLink(links[songID], 0, -1)
+		pdf.Bookmark(tr(entry.Item.Name), 0, 0)
+		delete(links, songID)
+
+		pdf.SetY(100)
+		pdf.SetFont("Helvetica", "B", 22)
+		pdf.MultiCell(0, 11, tr(entry.Item.Name), "", "C", false)
+		if credit := songCredit(entry.Item); credit != "" {
+			pdf.SetFont("Helvetica", "", 12)
+			pdf.CellFormat(0, 8, tr(credit), "", 1, "C", false, 0, "")
+		}
+		pdf.Ln(10)
+		pdf.SetFont("Helvetica", "I", 11)
+		pdf.SetTextColor(128, 128, 128)
+		pdf.CellFormat(0, 8, "No sheet music file is attached to this song.", "", 1, "C", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+	}
+
+	return pdf.Output(buffer)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// SetlistCollaborator is a struct that models a collection member who can view or edit a setlist they don't own,
+// both in the request body, and in the DB
+type SetlistCollaborator struct {
+	UserID  int64  `json:"user_id"`
+	Name    string `json:"name,omitempty"`
+	CanEdit bool   `json:"can_edit"`
+}
+
+// SetlistCollaboratorsHandler handles GETting the collaborators of a setlist and POSTing a new collaborator.
+// Only the owner of the setlist can add collaborators.
+func SetlistCollaboratorsHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Setlist Collaborators handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Collaborators handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Collaborators handler - Unable to parse setlist id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	// Verify Setlist ID
+	var ownerID, actualCollectionID int64
+	if err = db.QueryRow("SELECT user_id, collection_id FROM setlists WHERE setlist_id = $1", setlistID).Scan(&ownerID, &actualCollectionID); err != nil || actualCollectionID != collectionID {
+		log.Printf("Setlist Collaborators handler - Setlist %d not found in collection %d: %v\n", setlistID, collectionID, err)
+		SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "GET" {
+		rows, err := db.Query("SELECT c.user_id, u.name, c.can_edit FROM setlist_collaborators AS c JOIN users AS u ON u.user_id = c.user_id WHERE c.setlist_id = $1 ORDER BY u.name", setlistID)
+		if err != nil {
+			log.Printf("Setlist Collaborators GET - Unable to retrieve collaborators from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// Retrieve rows from database
+		collaborators := make([]SetlistCollaborator, 0)
+		for rows.Next() {
+			var collaborator SetlistCollaborator
+			if err := rows.Scan(&collaborator.UserID, &collaborator.Name, &collaborator.CanEdit); err != nil {
+				log.Printf("Setlist Collaborators GET - Unable to retrieve row from database result: %v\n", err)
+				continue
+			}
+			collaborators = append(collaborators, collaborator)
+		}
+
+		// Check for errors from iterating over rows.
+		if err := rows.Err(); err != nil {
+			log.Printf("Setlist Collaborators GET - Unable to get collaborators from database result: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(collaborators)
+		return
+
+	} else if r.Method == "POST" {
+		if ownerID != session.Values["user_id"].(int64) {
+			SendError(w, `{"error": "Only the owner of this setlist can add collaborators."}`, http.StatusForbidden)
+			return
+		}
+
+		var collaborator SetlistCollaborator
+		if err := json.NewDecoder(r.Body).Decode(&collaborator); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Collaborators POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if collaborator.UserID == ownerID {
+			SendError(w, `{"error": "The owner of a setlist can't also be a collaborator."}`, http.StatusBadRequest)
+			return
+		}
+
+		if err = db.QueryRow("SELECT name FROM collection_members NATURAL JOIN users WHERE collection_id = $1 AND user_id = $2", collectionID, collaborator.UserID).Scan(&collaborator.Name); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Collaborators must be members of this collection."}`, http.StatusBadRequest)
+			} else {
+				log.Printf("Setlist Collaborators POST - Unable to verify collection member: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Adding an existing collaborator changes what they can do
+		if _, err = db.Exec(`
+			INSERT INTO setlist_collaborators(setlist_id, user_id, can_edit) VALUES ($1, $2, $3)
+			ON CONFLICT (setlist_id, user_id) DO UPDATE SET can_edit = EXCLUDED.can_edit`, setlistID, collaborator.UserID, collaborator.CanEdit); err != nil {
+			log.Printf("Setlist Collaborators POST - Unable to insert collaborator in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(collaborator)
+		return
+	}
+}
+
+// SetlistCollaboratorHandler handles changing whether a collaborator can edit a setlist, and removing a collaborator.
+// Only the owner can change collaborators, but collaborators can remove themselves.
+func SetlistCollaboratorHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Setlist Collaborator handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Collaborator handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Collaborator handler - Unable to parse setlist id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Collaborator handler - Unable to parse user id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	// Verify Setlist ID
+	var ownerID, actualCollectionID int64
+	if err = db.QueryRow("SELECT user_id, collection_id FROM setlists WHERE setlist_id = $1", setlistID).Scan(&ownerID, &actualCollectionID); err != nil || actualCollectionID != collectionID {
+		log.Printf("Setlist Collaborator handler - Setlist %d not found in collection %d: %v\n", setlistID, collectionID, err)
+		SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+		return
+	}
+
+	sessionUserID := session.Values["user_id"].(int64)
+	if ownerID != sessionUserID && !(r.Method == "DELETE" && userID == sessionUserID) {
+		SendError(w, `{"error": "Only the owner of this setlist can change its collaborators."}`, http.StatusForbidden)
+		return
+	}
+
+	var result sql.Result
+	if r.Method == "PUT" {
+		var collaborator SetlistCollaborator
+		if err := json.NewDecoder(r.Body).Decode(&collaborator); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Collaborator PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		if result, err = db.Exec("UPDATE setlist_collaborators SET can_edit = $1 WHERE setlist_id = $2 AND user_id = $3", collaborator.CanEdit, setlistID, userID); err != nil {
+			log.Printf("Setlist Collaborator PUT - Unable to update collaborator in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+	} else if r.Method == "DELETE" {
+		if result, err = db.Exec("DELETE FROM setlist_collaborators WHERE setlist_id = $1 AND user_id = $2", setlistID, userID); err != nil {
+			log.Printf("Setlist Collaborator DELETE - Unable to delete collaborator from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		return
+	}
+
+	// Check if anything changed
+	if rows, err := result.RowsAffected(); err != nil {
+		log.Printf("Setlist Collaborator %s - Unable to get rows affected: %v\n", r.Method, err)
+		SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	} else if rows == 0 {
+		SendError(w, `{"error": "Collaborator not found."}`, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// SetlistOwnerHandler handles transferring a setlist to another collection member.
+// The previous owner stays on as a collaborator who can edit the setlist.
+func SetlistOwnerHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Setlist Owner handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Owner handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Owner handler - Unable to parse setlist id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "PUT" {
+		var owner SetlistCollaborator
+		if err := json.NewDecoder(r.Body).Decode(&owner); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Owner PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Only the owner can give a setlist away
+		var ownerID, actualCollectionID int64
+		if err = db.QueryRow("SELECT user_id, collection_id FROM setlists WHERE setlist_id = $1", setlistID).Scan(&ownerID, &actualCollectionID); err != nil || actualCollectionID != collectionID {
+			log.Printf("Setlist Owner PUT - Setlist %d not found in collection %d: %v\n", setlistID, collectionID, err)
+			SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+			return
+		}
+
+		if ownerID != session.Values["user_id"].(int64) {
+			SendError(w, `{"error": "Only the owner of this setlist can transfer it."}`, http.StatusForbidden)
+			return
+		}
+
+		if owner.UserID == ownerID {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		var isMember bool
+		if err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM collection_members WHERE collection_id = $1 AND user_id = $2)", collectionID, owner.UserID).Scan(&isMember); err != nil {
+			log.Printf("Setlist Owner PUT - Unable to verify collection member: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if !isMember {
+			SendError(w, `{"error": "Setlists can only be transferred to members of this collection."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Setlist Owner PUT - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("DELETE FROM setlist_collaborators WHERE setlist_id = $1 AND user_id = $2", setlistID, owner.UserID); err != nil {
+			log.Printf("Setlist Owner PUT - Unable to remove new owner from collaborators: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Owner PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("INSERT INTO setlist_collaborators(setlist_id, user_id, can_edit) VALUES ($1, $2, true)", setlistID, ownerID); err != nil {
+			log.Printf("Setlist Owner PUT - Unable to add previous owner to collaborators: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Owner PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("UPDATE setlists SET user_id = $1 WHERE setlist_id = $2", owner.UserID, setlistID); err != nil {
+			log.Printf("Setlist Owner PUT - Unable to update setlist owner: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Owner PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Setlist Owner PUT - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Setlist Owner PUT - User %d transferred setlist %d to user %d.\n", ownerID, setlistID, owner.UserID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jung-kurt/gofpdf"
+)
+
+// SetlistProgram is the content of a printed setlist
+type SetlistProgram struct {
+	Name     string
+	Date     *time.Time
+	Notes    string
+	Sections []SetlistSection
+	Runtime  int64
+}
+
+// Program templates. The conductor's running order has timings, keys and instructions for the performers,
+// while the audience program only has what the audience needs to know.
+const (
+	conductorTemplate = "conductor"
+	audienceTemplate  = "audience"
+)
+
+// Characters that can't be used in a file name
+var fileNamePattern = regexp.MustCompile(`[^A-Za-z0-9 _-]+`)
+
+// SetlistProgramHandler handles GETting a printable PDF of a setlist
+func SetlistProgramHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Program handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Program handler - Unable to parse setlist id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		template, ok := programTemplate(r)
+		if !ok {
+			SendError(w, `{"error": "Unknown program template."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Find the setlist in the database
+		var program SetlistProgram
+		if err = db.QueryRow("SELECT name, date, COALESCE(notes, '') FROM setlists WHERE setlist_id = $1 AND collection_id = $2", setlistID, collectionID).Scan(&program.Name, &program.Date, &program.Notes); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Setlist Program GET - Unable to get setlist from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if program.Sections, program.Runtime, _, err = getSetlistPlan(setlistID); err != nil {
+			log.Printf("Setlist Program GET - Unable to get items in setlist %d from database: %v\n", setlistID, err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		sendSetlistProgram(w, program, template)
+		return
+	}
+}
+
+// PublicSetlistProgramHandler handles GETting a printable PDF of a public setlist
+func PublicSetlistProgramHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	shareCode := mux.Vars(r)["share_code"]
+
+	if r.Method == "GET" {
+		template, ok := programTemplate(r)
+		if !ok {
+			SendError(w, `{"error": "Unknown program template."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Find the setlist in the database
+		var program SetlistProgram
+		var setlistID int64
+		var publicDetails bool
+		if err := db.QueryRow("SELECT setlist_id, name, date, COALESCE(notes, ''), public_details FROM setlists WHERE share_code = $1 AND shared = true", shareCode).Scan(&setlistID, &program.Name, &program.Date, &program.Notes, &publicDetails); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Setlist not found"}`, http.StatusNotFound)
+			} else {
+				log.Printf("Public Setlist Program GET - Unable to get setlist from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		sections, runtime, _, err := getSetlistPlan(setlistID)
+		if err != nil {
+			log.Printf("Public Setlist Program GET - Unable to get items in setlist %v from database: %v\n", shareCode, err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Leave out the performance details unless the owner chose to show them
+		if !publicDetails {
+			for i := range sections {
+				for j := range sections[i].Items {
+					item := &sections[i].Items[j]
+					item.Notes, item.Key, item.Instruction, item.Performers = "", "", "", nil
+				}
+			}
+		}
+		program.Sections = sections
+		program.Runtime = runtime
+
+		sendSetlistProgram(w, program, template)
+		return
+	}
+}
+
+// programTemplate gets the program template from the URL. The audience program is the default.
+func programTemplate(r *http.Request) (string, bool) {
+	switch template := r.URL.Query().Get("template"); template {
+	case "", audienceTemplate:
+		return audienceTemplate, true
+	case conductorTemplate:
+		return conductorTemplate, true
+	default:
+		return template, false
+	}
+}
+
+// sendSetlistProgram renders a setlist program as a PDF and sends it to the client
+func sendSetlistProgram(w http.ResponseWriter, program SetlistProgram, template string) {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetTitle(program.Name, true)
+	pdf.SetCreator("Sheet Music Organizer", true)
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-15)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.SetTextColor(128, 128, 128)
+		pdf.CellFormat(0, 10, strconv.Itoa(pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	if template == conductorTemplate {
+		writeRunningOrder(pdf, tr, program)
+	} else {
+		writeAudienceProgram(pdf, tr, program)
+	}
+
+	var buffer bytes.Buffer
+	if err := pdf.Output(&buffer); err != nil {
+		log.Printf("Setlist Program - Unable to render PDF: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	fileName := strings.TrimSpace(fileNamePattern.ReplaceAllString(program.Name, ""))
+	if fileName == "" {
+		fileName = "Setlist"
+	}
+
+	w.Header().Add("Content-Type", "application/pdf")
+	w.Header().Add("Content-Disposition", fmt.Sprintf(`inline; filename="%s.pdf"`, fileName))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(buffer.Bytes()); err != nil {
+		log.Printf("Setlist Program - Unable to send PDF to client: %v\n", err)
+	}
+}
+
+// writeAudienceProgram writes a centered concert program with composers and soloists.
+// Setlist and entry notes are for the performers, so they are only in the running order.
+func writeAudienceProgram(pdf *gofpdf.Fpdf, tr func(string) string, program SetlistProgram) {
+	pdf.SetFont("Helvetica", "B", 24)
+	pdf.MultiCell(0, 12, tr(program.Name), "", "C", false)
+	if program.Date != nil {
+		pdf.SetFont("Helvetica", "", 12)
+		pdf.CellFormat(0, 8, program.Date.Format("Monday, January 2, 2006"), "", 1, "C", false, 0, "")
+	}
+	pdf.Ln(8)
+
+	for _, section := range program.Sections {
+		if section.Name != "" {
+			pdf.Ln(4)
+			pdf.SetFont("Helvetica", "B", 14)
+			pdf.CellFormat(0, 9, tr(section.Name), "", 1, "C", false, 0, "")
+			pdf.Ln(2)
+		}
+
+		for _, item := range section.Items {
+			// Free text items such as Intermission are shown on their own
+			if item.SongID == nil {
+				pdf.SetFont("Helvetica", "I", 12)
+				pdf.CellFormat(0, 8, tr(item.Name), "", 1, "C", false, 0, "")
+				pdf.Ln(2)
+				continue
+			}
+
+			pdf.SetFont("Helvetica", "B", 12)
+			pdf.CellFormat(0, 7, tr(item.Name), "", 1, "C", false, 0, "")
+			if credit := songCredit(item); credit != "" {
+				pdf.SetFont("Helvetica", "", 10)
+				pdf.CellFormat(0, 5, tr(credit), "", 1, "C", false, 0, "")
+			}
+			if len(item.Performers) > 0 {
+				pdf.SetFont("Helvetica", "I", 10)
+				pdf.CellFormat(0, 5, tr(performerCredit(item)), "", 1, "C", false, 0, "")
+			}
+			pdf.Ln(4)
+		}
+	}
+}
+
+// writeRunningOrder writes a numbered running order with start times, keys, instructions and notes for the conductor
+func writeRunningOrder(pdf *gofpdf.Fpdf, tr func(string) string, program SetlistProgram) {
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.MultiCell(0, 9, tr(program.Name), "", "L", false)
+	pdf.SetFont("Helvetica", "", 11)
+	summary := "Runtime " + formatDuration(program.Runtime)
+	if program.Date != nil {
+		summary = program.Date.Format("January 2, 2006") + " - " + summary
+	}
+	pdf.CellFormat(0, 6, summary, "", 1, "L", false, 0, "")
+	if program.Notes != "" {
+		pdf.SetFont("Helvetica", "I", 10)
+		pdf.MultiCell(0, 5, tr(program.Notes), "", "L", false)
+	}
+	pdf.Ln(4)
+
+	number := 0
+	for _, section := range program.Sections {
+		if section.Name != "" {
+			pdf.Ln(2)
+			pdf.SetFont("Helvetica", "B", 13)
+			pdf.CellFormat(0, 8, tr(section.Name), "B", 1, "L", false, 0, "")
+			pdf.Ln(1)
+		}
+
+		for _, item := range section.Items {
+			number++
+
+			start := ""
+			if item.Start != nil {
+				start = formatDuration(*item.Start)
+			}
+			duration := ""
+			if item.Duration != nil {
+				duration = formatDuration(*item.Duration)
+			}
+
+			pdf.SetFont("Helvetica", "", 10)
+			pdf.CellFormat(10, 6, strconv.Itoa(number)+".", "", 0, "R", false, 0, "")
+			pdf.CellFormat(16, 6, start, "", 0, "R", false, 0, "")
+			pdf.SetFont("Helvetica", "B", 11)
+			pdf.CellFormat(110, 6, " "+tr(item.Name), "", 0, "L", false, 0, "")
+			pdf.SetFont("Helvetica", "", 10)
+			pdf.CellFormat(20, 6, tr(item.Key), "", 0, "C", false, 0, "")
+			pdf.CellFormat(0, 6, duration, "", 1, "R", false, 0, "")
+
+			// Details are indented under the song name
+			details := make([]string, 0)
+			if credit := songCredit(item); credit != "" {
+				details = append(details, credit)
+			}
+			if len(item.Performers) > 0 {
+				details = append(details, performerCredit(item))
+			}
+			if item.Instruction != "" {
+				details = append(details, item.Instruction)
+			}
+			if item.Notes != "" {
+				details = append(details, item.Notes)
+			}
+			pdf.SetFont("Helvetica", "", 9)
+			for _, detail := range details {
+				pdf.SetX(pdf.GetX() + 27)
+				pdf.MultiCell(130, 4.5, tr(detail), "", "L", false)
+			}
+			pdf.Ln(1.5)
+		}
+	}
+}
+
+// songCredit gets the composer and arranger line for a song
+func songCredit(item SetlistItem) string {
+	credit := item.Artist
+	if item.Arranger != "" {
+		if credit != "" {
+			credit += ", "
+		}
+		credit += "arr. " + item.Arranger
+	}
+	return credit
+}
+
+// performerCredit lists the performers assigned to a song
+func performerCredit(item SetlistItem) string {
+	names := make([]string, 0, len(item.Performers))
+	for _, performer := range item.Performers {
+		names = append(names, performer.Name)
+	}
+
+	if len(names) == 1 {
+		return "Soloist: " + names[0]
+	}
+	return "Soloists: " + strings.Join(names, ", ")
+}
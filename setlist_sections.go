@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// SetlistSection is a struct that models a part of a setlist such as Prelude or Encore, both in the request body, and in the DB
+type SetlistSection struct {
+	SectionID *int64        `json:"section_id"`
+	Name      string        `json:"name"`
+	Order     int64         `json:"order"`
+	Items     []SetlistItem `json:"items"`
+}
+
+// SetlistSectionsHandler handles GETting the sections of a setlist and POSTing a new section.
+func SetlistSectionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Sections handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Sections handler - Unable to parse setlist id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	// Verify Setlist ID
+	var actualCollectionID int64
+	if err = db.QueryRow("SELECT collection_id FROM setlists WHERE setlist_id = $1", setlistID).Scan(&actualCollectionID); err != nil || actualCollectionID != collectionID {
+		log.Printf("Setlist Sections handler - Setlist %d not found in collection %d: %v\n", setlistID, collectionID, err)
+		SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "GET" {
+		sections, err := getSetlistSections(setlistID)
+		if err != nil {
+			log.Printf("Setlist Sections GET - Unable to retrieve sections from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(sections)
+		return
+
+	} else if r.Method == "POST" {
+		var section SetlistSection
+		if err := json.NewDecoder(r.Body).Decode(&section); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Sections POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if section.Name == "" {
+			SendError(w, `{"error": "No section name supplied."}`, http.StatusBadRequest)
+			return
+		}
+
+		// New sections go at the end unless an order is given
+		var sectionID int64
+		section.Items = make([]SetlistItem, 0)
+		if err = db.QueryRow(`
+			INSERT INTO setlist_sections(name, "order", setlist_id)
+			VALUES ($1, CASE WHEN $2 = 0 THEN (SELECT COALESCE(max("order"), 0) + 1 FROM setlist_sections WHERE setlist_id = $3) ELSE $2 END, $3)
+			RETURNING section_id, "order"`, section.Name, section.Order, setlistID).Scan(&sectionID, &section.Order); err != nil {
+			log.Printf("Setlist Sections POST - Unable to insert section in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		section.SectionID = &sectionID
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(section)
+		return
+	}
+}
+
+// SetlistSectionHandler handles renaming, reordering and deleting a single setlist section.
+func SetlistSectionHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Section handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Section handler - Unable to parse setlist id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	sectionID, err := strconv.ParseInt(mux.Vars(r)["section_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Section handler - Unable to parse section id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	// Verify Setlist ID
+	var actualCollectionID int64
+	if err = db.QueryRow("SELECT collection_id FROM setlists WHERE setlist_id = $1", setlistID).Scan(&actualCollectionID); err != nil || actualCollectionID != collectionID {
+		log.Printf("Setlist Section handler - Setlist %d not found in collection %d: %v\n", setlistID, collectionID, err)
+		SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "PUT" {
+		var section SetlistSection
+		if err := json.NewDecoder(r.Body).Decode(&section); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Section PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if section.Name == "" {
+			SendError(w, `{"error": "No section name supplied."}`, http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec(`UPDATE setlist_sections SET name = $1, "order" = $2 WHERE section_id = $3 AND setlist_id = $4`, section.Name, section.Order, sectionID, setlistID)
+		if err != nil {
+			log.Printf("Setlist Section PUT - Unable to update section in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Check if update did anything
+		if rows, err := result.RowsAffected(); err != nil {
+			log.Printf("Setlist Section PUT - Database update unsuccessful: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if rows == 0 {
+			SendError(w, `{"error": "Section not found."}`, http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+
+	} else if r.Method == "DELETE" {
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Setlist Section DELETE - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// The items stay in the setlist, outside of any section
+		if _, err = tx.Exec("UPDATE setlist_songs SET section_id = NULL WHERE section_id = $1 AND setlist_id = $2", sectionID, setlistID); err != nil {
+			log.Printf("Setlist Section DELETE - Unable to remove songs from section: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Section DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		var result sql.Result
+		if result, err = tx.Exec("DELETE FROM setlist_sections WHERE section_id = $1 AND setlist_id = $2", sectionID, setlistID); err != nil {
+			log.Printf("Setlist Section DELETE - Unable to delete section from database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Section DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Section DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, `{"error": "Section not found."}`, http.StatusNotFound)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Setlist Section DELETE - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
+
+// getSetlistSections gets the sections of a setlist in order, without their items
+func getSetlistSections(setlistID int64) ([]SetlistSection, error) {
+	rows, err := db.Query(`SELECT section_id, name, "order" FROM setlist_sections WHERE setlist_id = $1 ORDER BY "order", section_id`, setlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sections := make([]SetlistSection, 0)
+	for rows.Next() {
+		section := SetlistSection{Items: make([]SetlistItem, 0)}
+		if err := rows.Scan(&section.SectionID, &section.Name, &section.Order); err != nil {
+			return nil, err
+		}
+		sections = append(sections, section)
+	}
+
+	return sections, rows.Err()
+}
+
+// groupSetlistItems puts each item into its section. Items outside of any section come first, in an unnamed section.
+func groupSetlistItems(sections []SetlistSection, items []SetlistItem) []SetlistSection {
+	unsectioned := SetlistSection{Items: make([]SetlistItem, 0)}
+	sectionIndex := make(map[int64]int)
+	for i := range sections {
+		sectionIndex[*sections[i].SectionID] = i
+	}
+
+	for _, item := range items {
+		if item.SectionID != nil {
+			if i, ok := sectionIndex[*item.SectionID]; ok {
+				sections[i].Items = append(sections[i].Items, item)
+				continue
+			}
+		}
+		unsectioned.Items = append(unsectioned.Items, item)
+	}
+
+	if len(unsectioned.Items) > 0 {
+		sections = append([]SetlistSection{unsectioned}, sections...)
+	}
+	return sections
+}
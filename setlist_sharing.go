@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gorilla/mux"
+)
+
+// ShareLink is a struct that models the settings of a public setlist's share link, both in the request body, and in the DB
+type ShareLink struct {
+	ShareCode *string    `json:"share_code,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"` // The link never expires without an expiration date
+	// NeverExpires is only sent by the client to remove the expiration date.
+	// Like the password, the expiration date is left unchanged by an update that doesn't include either.
+	NeverExpires bool `json:"never_expires,omitempty"`
+	// Password is only sent by the client. It is left unchanged by an update that doesn't include it,
+	// and an empty password removes it.
+	Password     *string         `json:"password,omitempty"`
+	HasPassword  bool            `json:"has_password"`
+	Views        int64           `json:"views"`
+	LastAccessed *time.Time      `json:"last_accessed,omitempty"`
+	History      []PastShareLink `json:"history,omitempty"`
+}
+
+// PastShareLink is a share code a setlist has had, and when it stopped working
+type PastShareLink struct {
+	ShareCode string     `json:"share_code"`
+	Created   time.Time  `json:"created"`
+	Revoked   *time.Time `json:"revoked,omitempty"`
+}
+
+// SetlistShareHandler handles GETting and updating the settings of a setlist's share link
+func SetlistShareHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Setlist Share handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Share handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Share handler - Unable to parse setlist id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	// Find the share link in the database
+	var link ShareLink
+	var ownerID int64
+	if err = db.QueryRow("SELECT share_code, share_expires, share_password IS NOT NULL, views, last_accessed, user_id FROM setlists WHERE setlist_id = $1 AND collection_id = $2", setlistID, collectionID).Scan(
+		&link.ShareCode, &link.Expires, &link.HasPassword, &link.Views, &link.LastAccessed, &ownerID); err != nil {
+		if err == sql.ErrNoRows {
+			SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+		} else {
+			log.Printf("Setlist Share handler - Unable to get setlist from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if r.Method == "GET" {
+		rows, err := db.Query("SELECT share_code, created, revoked FROM setlist_share_links WHERE setlist_id = $1 ORDER BY created DESC", setlistID)
+		if err != nil {
+			log.Printf("Setlist Share GET - Unable to get share link history from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		link.History = make([]PastShareLink, 0)
+		for rows.Next() {
+			var past PastShareLink
+			if err := rows.Scan(&past.ShareCode, &past.Created, &past.Revoked); err != nil {
+				log.Printf("Setlist Share GET - Unable to retrieve row from database result: %v\n", err)
+				continue
+			}
+			link.History = append(link.History, past)
+		}
+
+		// Check for errors from iterating over rows.
+		if err := rows.Err(); err != nil {
+			log.Printf("Setlist Share GET - Unable to get share link history from database result: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(link)
+		return
+
+	} else if r.Method == "PUT" {
+		if ownerID != session.Values["user_id"].(int64) {
+			SendError(w, `{"error": "Only the owner of this setlist can change its share link."}`, http.StatusForbidden)
+			return
+		}
+
+		if link.ShareCode == nil {
+			SendError(w, `{"error": "Only public setlists have a share link."}`, http.StatusBadRequest)
+			return
+		}
+
+		var settings ShareLink
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Share PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if settings.Expires != nil && settings.NeverExpires {
+			SendError(w, `{"error": "A share link can't have an expiration date and never expire."}`, http.StatusBadRequest)
+			return
+		}
+
+		if settings.Expires != nil && settings.Expires.Before(time.Now()) {
+			SendError(w, `{"error": "The expiration date must be in the future."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Hash the new password. Without a new password, the current one is kept.
+		var passwordHash *string
+		removePassword := settings.Password != nil && *settings.Password == ""
+		if settings.Password != nil && *settings.Password != "" {
+			hash, err := hashPassword(*settings.Password)
+			if err != nil {
+				log.Printf("Setlist Share PUT - Unable to hash password: %v\n", err)
+				SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+			passwordHash = &hash
+		}
+
+		if _, err = db.Exec(`
+			UPDATE setlists SET share_expires = CASE WHEN $5 THEN NULL ELSE COALESCE($1, share_expires) END,
+			       share_password = CASE WHEN $2 THEN NULL ELSE COALESCE($3, share_password) END,
+			       share_password_changed = CASE WHEN $2 THEN NULL WHEN $3::text IS NOT NULL THEN now() ELSE share_password_changed END
+			WHERE setlist_id = $4`, settings.Expires, removePassword, passwordHash, setlistID, settings.NeverExpires); err != nil {
+			log.Printf("Setlist Share PUT - Unable to update share link in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
+
+// SetlistShareRotateHandler handles replacing a public setlist's share code, so the old link stops working.
+// The setlist stays public, and keeps its expiration and password.
+func SetlistShareRotateHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Setlist Share Rotate handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Share Rotate handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Share Rotate handler - Unable to parse setlist id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		var currentCode *string
+		var ownerID int64
+		if err = db.QueryRow("SELECT share_code, user_id FROM setlists WHERE setlist_id = $1 AND collection_id = $2", setlistID, collectionID).Scan(&currentCode, &ownerID); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Setlist Share Rotate POST - Unable to get setlist from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if ownerID != session.Values["user_id"].(int64) {
+			SendError(w, `{"error": "Only the owner of this setlist can change its share link."}`, http.StatusForbidden)
+			return
+		}
+
+		if currentCode == nil {
+			SendError(w, `{"error": "Only public setlists have a share link."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Setlist Share Rotate POST - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		shareCode := uniuri.New()
+		if _, err = tx.Exec("UPDATE setlists SET share_code = $1 WHERE setlist_id = $2", shareCode, setlistID); err != nil {
+			log.Printf("Setlist Share Rotate POST - Unable to update share code in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Share Rotate POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = replaceShareLink(tx, setlistID, shareCode); err != nil {
+			log.Printf("Setlist Share Rotate POST - Unable to update share link history: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Share Rotate POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Setlist Share Rotate POST - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err = w.Write([]byte(shareCode)); err != nil {
+			log.Printf("Setlist Share Rotate POST - Unable to send share code to client: %v\n", err)
+		}
+		return
+	}
+}
+
+// replaceShareLink revokes a setlist's current share code in its share link history, and records the new one.
+// An empty share code only revokes the current one.
+func replaceShareLink(tx *sql.Tx, setlistID int64, shareCode string) error {
+	if _, err := tx.Exec("UPDATE setlist_share_links SET revoked = now() WHERE setlist_id = $1 AND revoked IS NULL", setlistID); err != nil {
+		return err
+	}
+
+	if shareCode == "" {
+		return nil
+	}
+
+	_, err := tx.Exec("INSERT INTO setlist_share_links(share_code, setlist_id) VALUES ($1, $2)", shareCode, setlistID)
+	return err
+}
+
+// shareLinkSessionKey is the session value that records when a visitor unlocked a password protected share link
+func shareLinkSessionKey(shareCode string) string {
+	return "share_link_" + shareCode
+}
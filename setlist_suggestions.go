@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// SetlistSuggestionRequest models the constraints for suggesting a setlist.
+// TargetDuration and Gap are in seconds, and Gap is counted between songs. Only songs with a duration
+// are suggested when there is a target duration. Songs must have all of RequiredTags and none of ExcludedTags,
+// where a tag also matches songs tagged with any of its child tags.
+// The same Seed always gives the same suggestion for the same songs.
+type SetlistSuggestionRequest struct {
+	TargetDuration     int64      `json:"target_duration,omitempty"`
+	Gap                int64      `json:"gap,omitempty"`
+	Songs              int        `json:"songs,omitempty"`
+	RequiredTags       []int64    `json:"required_tags,omitempty"`
+	ExcludedTags       []int64    `json:"excluded_tags,omitempty"`
+	NotPerformedMonths int        `json:"not_performed_months,omitempty"`
+	KeyVariety         bool       `json:"key_variety,omitempty"`
+	Seed               *int64     `json:"seed,omitempty"`
+	Name               string     `json:"name,omitempty"`
+	Date               *time.Time `json:"date,omitempty"`
+}
+
+// SuggestedSong is a song in a suggested setlist. Songs that haven't been performed for longer score higher.
+type SuggestedSong struct {
+	SongID        int64   `json:"song_id"`
+	Name          string  `json:"name"`
+	Key           string  `json:"key,omitempty"`
+	Duration      *int64  `json:"duration,omitempty"`
+	LastPerformed *string `json:"last_performed,omitempty"`
+	Score         float64 `json:"score"`
+}
+
+// SetlistSuggestion is a draft setlist in the order it would be performed
+type SetlistSuggestion struct {
+	Seed      int64           `json:"seed"`
+	Songs     []SuggestedSong `json:"songs"`
+	Runtime   int64           `json:"runtime"`
+	Warnings  []string        `json:"warnings"`
+	SetlistID *int64          `json:"setlist_id,omitempty"`
+}
+
+// Limits for suggestions
+const (
+	defaultSuggestedSongs = 10
+	maxSuggestedSongs     = 100
+	maxStaleDays          = 3650
+)
+
+// SetlistSuggestionHandler handles POSTing constraints to get a suggested setlist.
+// With ?accept=true, the suggestion is saved as a new setlist.
+func SetlistSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Setlist Suggestion handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Suggestion handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		var request SetlistSuggestionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Suggestion POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if request.TargetDuration < 0 || request.Gap < 0 || request.Songs < 0 || request.NotPerformedMonths < 0 {
+			SendError(w, `{"error": "Constraints cannot be negative."}`, http.StatusBadRequest)
+			return
+		}
+
+		if request.Songs > maxSuggestedSongs {
+			SendError(w, fmt.Sprintf(`{"error": "At most %d songs can be suggested."}`, maxSuggestedSongs), http.StatusBadRequest)
+			return
+		}
+
+		if request.Songs == 0 && request.TargetDuration == 0 {
+			request.Songs = defaultSuggestedSongs
+		}
+
+		accept := r.URL.Query().Get("accept") == "true"
+		if accept && request.Name == "" {
+			SendError(w, `{"error": "Cannot create a setlist with a blank name."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Without a seed, pick one and send it back so the suggestion can be repeated
+		suggestion := SetlistSuggestion{Songs: make([]SuggestedSong, 0), Warnings: make([]string, 0)}
+		if request.Seed != nil {
+			suggestion.Seed = *request.Seed
+		} else {
+			suggestion.Seed = time.Now().UnixNano()
+		}
+
+		candidates, err := getSuggestionCandidates(collectionID, request)
+		if err != nil {
+			log.Printf("Setlist Suggestion POST - Unable to get songs from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		rankSuggestionCandidates(candidates, suggestion.Seed)
+		suggestion.Songs, suggestion.Runtime = pickSuggestedSongs(candidates, request)
+
+		// Explain why the draft might not be what was asked for
+		if request.Songs > 0 && len(suggestion.Songs) < request.Songs {
+			suggestion.Warnings = append(suggestion.Warnings, fmt.Sprintf("Only %d songs fit the constraints.", len(suggestion.Songs)))
+		}
+		if request.TargetDuration > 0 {
+			untimed := 0
+			for _, song := range candidates {
+				if song.Duration == nil {
+					untimed++
+				}
+			}
+			if untimed > 0 {
+				suggestion.Warnings = append(suggestion.Warnings, fmt.Sprintf("%d songs were left out because they have no duration.", untimed))
+			}
+			if suggestion.Runtime < request.TargetDuration*9/10 {
+				suggestion.Warnings = append(suggestion.Warnings, fmt.Sprintf("The draft runs %s, short of the target duration of %s.", formatDuration(suggestion.Runtime), formatDuration(request.TargetDuration)))
+			}
+		}
+
+		if !accept {
+			// Send response
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(suggestion)
+			return
+		}
+
+		// Save the draft as a new setlist
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Setlist Suggestion POST - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		var setlistID int64
+		var targetLength *int64
+		if request.TargetDuration > 0 {
+			targetLength = &request.TargetDuration
+		}
+		if err = tx.QueryRow("INSERT INTO setlists(name, date, gap, target_length, collection_id, user_id) VALUES ($1, $2, $3, $4, $5, $6) RETURNING setlist_id",
+			request.Name, request.Date, request.Gap, targetLength, collectionID, session.Values["user_id"]).Scan(&setlistID); err != nil {
+			log.Printf("Setlist Suggestion POST - Unable to insert setlist into database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Suggestion POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		for i, song := range suggestion.Songs {
+			if _, err = tx.Exec(`INSERT INTO setlist_songs(setlist_id, song_id, "order") VALUES ($1, $2, $3)`, setlistID, song.SongID, i+1); err != nil {
+				log.Printf("Setlist Suggestion POST - Unable to add song %d to setlist: %v\n", song.SongID, err)
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					log.Printf("Setlist Suggestion POST - Unable to rollback transaction: %v\n", rollbackErr)
+				}
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Setlist Suggestion POST - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		suggestion.SetlistID = &setlistID
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(suggestion)
+		return
+	}
+}
+
+// getSuggestionCandidates gets the songs in a collection that meet the tag and last performed constraints, in a stable order
+func getSuggestionCandidates(collectionID int64, request SetlistSuggestionRequest) ([]SuggestedSong, error) {
+	requiredTags := uniqueIDs(request.RequiredTags)
+	rows, err := db.Query(`
+		SELECT s.song_id, s.name, COALESCE(s.key, ''), s.duration, s.last_performed,
+		       COALESCE(current_date - s.last_performed, $5)
+		FROM songs AS s
+		WHERE s.collection_id = $1
+		  AND (SELECT count(DISTINCT ta.ancestor_id) FROM tagged_songs AS ts JOIN tag_ancestors AS ta ON ta.tag_id = ts.tag_id WHERE ts.song_id = s.song_id AND ta.ancestor_id = ANY($2)) = cardinality($2::integer[])
+		  AND NOT EXISTS (SELECT 1 FROM tagged_songs AS ts JOIN tag_ancestors AS ta ON ta.tag_id = ts.tag_id WHERE ts.song_id = s.song_id AND ta.ancestor_id = ANY($3))
+		  AND ($4 = 0 OR s.last_performed IS NULL OR s.last_performed < current_date - make_interval(months => $4))
+		ORDER BY s.song_id`, collectionID, pq.Array(requiredTags), pq.Array(request.ExcludedTags), request.NotPerformedMonths, maxStaleDays)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := make([]SuggestedSong, 0)
+	for rows.Next() {
+		var song SuggestedSong
+		var staleDays int64
+		if err := rows.Scan(&song.SongID, &song.Name, &song.Key, &song.Duration, &song.LastPerformed, &staleDays); err != nil {
+			return nil, err
+		}
+		song.Score = float64(staleDays)
+		candidates = append(candidates, song)
+	}
+
+	return candidates, rows.Err()
+}
+
+// rankSuggestionCandidates scores songs by how long ago they were performed, with some seeded randomness
+// so the same repertoire doesn't always come up, and sorts them best first.
+func rankSuggestionCandidates(candidates []SuggestedSong, seed int64) {
+	random := rand.New(rand.NewSource(seed))
+	for i := range candidates {
+		staleness := math.Min(candidates[i].Score, maxStaleDays) / maxStaleDays
+		candidates[i].Score = math.Round((staleness+0.5*random.Float64())*1000) / 1000
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+}
+
+// pickSuggestedSongs picks the best ranked songs that fit the number of songs and target duration.
+// With key variety, a song is not placed right after a song in the same key. Songs without a duration are skipped
+// when there is a target duration. It returns the songs and their runtime, including the gaps between them.
+func pickSuggestedSongs(candidates []SuggestedSong, request SetlistSuggestionRequest) ([]SuggestedSong, int64) {
+	picked := make([]SuggestedSong, 0)
+	used := make([]bool, len(candidates))
+	var runtime int64
+
+	limit := request.Songs
+	if limit == 0 {
+		limit = maxSuggestedSongs
+	}
+
+	for len(picked) < limit {
+		// The gap comes between songs, so not before the first one
+		var gap int64
+		previousKey := ""
+		if len(picked) > 0 {
+			gap = request.Gap
+			previousKey = picked[len(picked)-1].Key
+		}
+
+		next := -1
+		for i, song := range candidates {
+			if used[i] {
+				continue
+			}
+			if request.TargetDuration > 0 && (song.Duration == nil || runtime+gap+*song.Duration > request.TargetDuration) {
+				continue
+			}
+			if request.KeyVariety && song.Key != "" && strings.EqualFold(song.Key, previousKey) {
+				continue
+			}
+			next = i
+			break
+		}
+
+		if next < 0 {
+			break
+		}
+
+		used[next] = true
+		picked = append(picked, candidates[next])
+		runtime += gap
+		if candidates[next].Duration != nil {
+			runtime += *candidates[next].Duration
+		}
+
+		if request.TargetDuration > 0 && runtime >= request.TargetDuration {
+			break
+		}
+	}
+
+	return picked, runtime
+}
@@ -0,0 +1,725 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// SetlistTemplate is a struct that models the shape of a setlist that is used again and again, such as a weekly service,
+// both in the request body, and in the DB
+type SetlistTemplate struct {
+	TemplateID   int64          `json:"template_id"`
+	Name         string         `json:"name"`
+	Notes        string         `json:"notes,omitempty"`
+	Gap          *int64         `json:"gap,omitempty"`
+	TargetLength *int64         `json:"target_length,omitempty"`
+	Slots        []TemplateSlot `json:"slots"`
+	CollectionID int64          `json:"collection_id"`
+}
+
+// TemplateSlot is a placeholder in a setlist template, such as Opening hymn or Anthem.
+// A slot can suggest a song, and slots with the same section name are grouped into a section.
+type TemplateSlot struct {
+	SlotID   int64  `json:"slot_id"`
+	Label    string `json:"label"`
+	Section  string `json:"section,omitempty"`
+	Duration *int64 `json:"duration,omitempty"`
+	SongID   *int64 `json:"song_id,omitempty"`
+	Order    int64  `json:"order"`
+}
+
+// SlotFill is the song or text that fills a template slot when a setlist is created from the template
+type SlotFill struct {
+	SlotID int64  `json:"slot_id"`
+	SongID *int64 `json:"song_id,omitempty"`
+	Title  string `json:"title,omitempty"`
+}
+
+// SetlistFromTemplateRequest models the request body for creating a setlist from a template.
+// Slots that aren't filled use the slot's suggested song, or become a free text item with the slot's label.
+type SetlistFromTemplateRequest struct {
+	Name  string     `json:"name"`
+	Date  *time.Time `json:"date,omitempty"`
+	Slots []SlotFill `json:"slots"`
+}
+
+// SetlistCopyRequest models the request body for copying a setlist. The copy keeps the original name if none is given.
+type SetlistCopyRequest struct {
+	Name string     `json:"name"`
+	Date *time.Time `json:"date,omitempty"`
+}
+
+// SetlistTemplatesHandler handles GETting all setlist templates in a collection and POSTing a new template.
+func SetlistTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Templates handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		rows, err := db.Query("SELECT template_id, name, COALESCE(notes, ''), gap, target_length FROM setlist_templates WHERE collection_id = $1 ORDER BY name", collectionID)
+		if err != nil {
+			log.Printf("Setlist Templates GET - Unable to retrieve templates from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// Retrieve rows from database
+		templates := make([]SetlistTemplate, 0)
+		for rows.Next() {
+			template := SetlistTemplate{CollectionID: collectionID}
+			if err := rows.Scan(&template.TemplateID, &template.Name, &template.Notes, &template.Gap, &template.TargetLength); err != nil {
+				log.Printf("Setlist Templates GET - Unable to retrieve row from database result: %v\n", err)
+				continue
+			}
+			templates = append(templates, template)
+		}
+
+		// Check for errors from iterating over rows.
+		if err := rows.Err(); err != nil {
+			log.Printf("Setlist Templates GET - Unable to get templates from database result: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		for i := range templates {
+			if templates[i].Slots, err = getTemplateSlots(templates[i].TemplateID); err != nil {
+				log.Printf("Setlist Templates GET - Unable to get slots of template %d: %v\n", templates[i].TemplateID, err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(templates)
+		return
+
+	} else if r.Method == "POST" {
+		var template SetlistTemplate
+		if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Templates POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if message, err := checkSetlistTemplate(&template, collectionID); err != nil {
+			log.Printf("Setlist Templates POST - Unable to verify template: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Setlist Templates POST - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		template.CollectionID = collectionID
+		if err = tx.QueryRow("INSERT INTO setlist_templates(name, notes, gap, target_length, collection_id) VALUES ($1, $2, COALESCE($3, 0), NULLIF($4, 0), $5) RETURNING template_id",
+			template.Name, template.Notes, template.Gap, template.TargetLength, collectionID).Scan(&template.TemplateID); err != nil {
+			log.Printf("Setlist Templates POST - Unable to insert template in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Templates POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = insertTemplateSlots(tx, template.TemplateID, template.Slots); err != nil {
+			log.Printf("Setlist Templates POST - Unable to insert template slots in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Templates POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Setlist Templates POST - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			TemplateID int64 `json:"template_id"`
+		}{
+			template.TemplateID,
+		})
+		return
+	}
+}
+
+// SetlistTemplateHandler handles GETting, updating, or deleting a single setlist template.
+// Updating a template replaces all of its slots.
+func SetlistTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Template handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	templateID, err := strconv.ParseInt(mux.Vars(r)["template_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Template handler - Unable to parse template id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	// Verify Template ID
+	var actualCollectionID int64
+	if err = db.QueryRow("SELECT collection_id FROM setlist_templates WHERE template_id = $1", templateID).Scan(&actualCollectionID); err != nil || actualCollectionID != collectionID {
+		log.Printf("Setlist Template handler - Template %d not found in collection %d: %v\n", templateID, collectionID, err)
+		SendError(w, `{"error": "Setlist template not found."}`, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "GET" {
+		template := SetlistTemplate{TemplateID: templateID, CollectionID: collectionID}
+		if err = db.QueryRow("SELECT name, COALESCE(notes, ''), gap, target_length FROM setlist_templates WHERE template_id = $1", templateID).Scan(&template.Name, &template.Notes, &template.Gap, &template.TargetLength); err != nil {
+			log.Printf("Setlist Template GET - Unable to get template from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if template.Slots, err = getTemplateSlots(templateID); err != nil {
+			log.Printf("Setlist Template GET - Unable to get template slots from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(template)
+		return
+
+	} else if r.Method == "PUT" {
+		var template SetlistTemplate
+		if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Template PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if message, err := checkSetlistTemplate(&template, collectionID); err != nil {
+			log.Printf("Setlist Template PUT - Unable to verify template: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Setlist Template PUT - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("UPDATE setlist_templates SET name = $1, notes = $2, gap = COALESCE($3, 0), target_length = NULLIF($4, 0) WHERE template_id = $5",
+			template.Name, template.Notes, template.Gap, template.TargetLength, templateID); err != nil {
+			log.Printf("Setlist Template PUT - Unable to update template in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Template PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("DELETE FROM setlist_template_slots WHERE template_id = $1", templateID); err != nil {
+			log.Printf("Setlist Template PUT - Unable to remove template slots: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Template PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = insertTemplateSlots(tx, templateID, template.Slots); err != nil {
+			log.Printf("Setlist Template PUT - Unable to insert template slots: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Template PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Setlist Template PUT - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+
+	} else if r.Method == "DELETE" {
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Setlist Template DELETE - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("DELETE FROM setlist_template_slots WHERE template_id = $1", templateID); err != nil {
+			log.Printf("Setlist Template DELETE - Unable to delete template slots: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Template DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("DELETE FROM setlist_templates WHERE template_id = $1", templateID); err != nil {
+			log.Printf("Setlist Template DELETE - Unable to delete template: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Template DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Setlist Template DELETE - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
+
+// SetlistFromTemplateHandler handles POSTing a new setlist created from a template
+func SetlistFromTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Setlist From Template handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist From Template handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	templateID, err := strconv.ParseInt(mux.Vars(r)["template_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist From Template handler - Unable to parse template id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		var request SetlistFromTemplateRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist From Template POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Find the template in the database
+		var template SetlistTemplate
+		if err = db.QueryRow("SELECT name, COALESCE(notes, ''), gap, target_length FROM setlist_templates WHERE template_id = $1 AND collection_id = $2", templateID, collectionID).Scan(&template.Name, &template.Notes, &template.Gap, &template.TargetLength); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Setlist template not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Setlist From Template POST - Unable to get template from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if template.Slots, err = getTemplateSlots(templateID); err != nil {
+			log.Printf("Setlist From Template POST - Unable to get template slots from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Fill in the slots
+		fills := make(map[int64]SlotFill)
+		songIDs := make([]int64, 0)
+		for _, fill := range request.Slots {
+			fills[fill.SlotID] = fill
+			if fill.SongID != nil {
+				songIDs = append(songIDs, *fill.SongID)
+			}
+		}
+
+		if message, err := checkCollectionSongs(songIDs, collectionID); err != nil {
+			log.Printf("Setlist From Template POST - Unable to verify songs: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
+		if request.Name == "" {
+			request.Name = template.Name
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Setlist From Template POST - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		var setlistID int64
+		if err = tx.QueryRow("INSERT INTO setlists(name, date, notes, gap, target_length, collection_id, user_id) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING setlist_id",
+			request.Name, request.Date, template.Notes, template.Gap, template.TargetLength, collectionID, session.Values["user_id"]).Scan(&setlistID); err != nil {
+			log.Printf("Setlist From Template POST - Unable to insert setlist into database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist From Template POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Slots with the same section name go into the same section, in the order the sections first appear
+		sections := make(map[string]int64)
+		for i, slot := range template.Slots {
+			var sectionID *int64
+			if slot.Section != "" {
+				if id, ok := sections[slot.Section]; ok {
+					sectionID = &id
+				} else {
+					if err = tx.QueryRow(`INSERT INTO setlist_sections(name, "order", setlist_id) VALUES ($1, $2, $3) RETURNING section_id`, slot.Section, len(sections)+1, setlistID).Scan(&id); err != nil {
+						break
+					}
+					sections[slot.Section] = id
+					sectionID = &id
+				}
+			}
+
+			songID, title := slot.SongID, slot.Label
+			if fill, ok := fills[slot.SlotID]; ok {
+				if fill.SongID != nil {
+					songID = fill.SongID
+				} else if fill.Title != "" {
+					songID, title = nil, fill.Title
+				}
+			}
+			if songID != nil {
+				title = ""
+			}
+
+			if _, err = tx.Exec(`INSERT INTO setlist_songs(setlist_id, song_id, title, duration, "order", section_id) VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)`,
+				setlistID, songID, title, slot.Duration, i+1, sectionID); err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			log.Printf("Setlist From Template POST - Unable to fill template slots: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist From Template POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Setlist From Template POST - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			SetlistID int64 `json:"setlist_id"`
+		}{
+			setlistID,
+		})
+		return
+	}
+}
+
+// SetlistCopyHandler handles POSTing a copy of a setlist with its sections, items, order and notes, usually for a new date.
+// The copy belongs to the user making it, and is private.
+func SetlistCopyHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "session")
+	if err != nil {
+		log.Printf("Setlist Copy handler - Unable to get session store: %v\n", err)
+		SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Copy handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Copy handler - Unable to parse setlist id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		var request SetlistCopyRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Copy POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Setlist Copy POST - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		var copyID int64
+		if err = tx.QueryRow(`
+			INSERT INTO setlists(name, date, notes, public_details, gap, target_length, collection_id, user_id)
+			SELECT COALESCE(NULLIF($1, ''), name), $2, notes, public_details, gap, target_length, collection_id, $3
+			FROM setlists WHERE setlist_id = $4 AND collection_id = $5
+			RETURNING setlist_id`, request.Name, request.Date, session.Values["user_id"], setlistID, collectionID).Scan(&copyID); err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Copy POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Setlist Copy POST - Unable to copy setlist: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if err = copySetlistItems(tx, setlistID, copyID); err != nil {
+			log.Printf("Setlist Copy POST - Unable to copy setlist items: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Copy POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Setlist Copy POST - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			SetlistID int64 `json:"setlist_id"`
+		}{
+			copyID,
+		})
+		return
+	}
+}
+
+// copySetlistItems copies the sections and items of a setlist, with their performers, into another setlist
+func copySetlistItems(tx *sql.Tx, fromSetlistID, toSetlistID int64) error {
+	// Copy sections, remembering which new section replaces each old one
+	sections := make(map[int64]int64)
+	rows, err := tx.Query("SELECT section_id FROM setlist_sections WHERE setlist_id = $1", fromSetlistID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var sectionID int64
+		if err := rows.Scan(&sectionID); err != nil {
+			rows.Close()
+			return err
+		}
+		sections[sectionID] = 0
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for oldID := range sections {
+		var newID int64
+		if err := tx.QueryRow(`INSERT INTO setlist_sections(name, "order", setlist_id) SELECT name, "order", $1 FROM setlist_sections WHERE section_id = $2 RETURNING section_id`, toSetlistID, oldID).Scan(&newID); err != nil {
+			return err
+		}
+		sections[oldID] = newID
+	}
+
+	// Copy items into the new sections
+	type copiedItem struct {
+		itemID    int64
+		sectionID *int64
+	}
+	items := make([]copiedItem, 0)
+	rows, err = tx.Query("SELECT item_id, section_id FROM setlist_songs WHERE setlist_id = $1", fromSetlistID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var item copiedItem
+		if err := rows.Scan(&item.itemID, &item.sectionID); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		var sectionID *int64
+		if item.sectionID != nil {
+			newSectionID := sections[*item.sectionID]
+			sectionID = &newSectionID
+		}
+
+		var newItemID int64
+		if err := tx.QueryRow(`
+			INSERT INTO setlist_songs(setlist_id, song_id, title, duration, "order", section_id, notes, performance_key, instruction)
+			SELECT $1, song_id, title, duration, "order", $2, notes, performance_key, instruction
+			FROM setlist_songs WHERE item_id = $3
+			RETURNING item_id`, toSetlistID, sectionID, item.itemID).Scan(&newItemID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("INSERT INTO setlist_performers(item_id, user_id) SELECT $1, user_id FROM setlist_performers WHERE item_id = $2", newItemID, item.itemID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getTemplateSlots gets the slots of a setlist template in order
+func getTemplateSlots(templateID int64) ([]TemplateSlot, error) {
+	rows, err := db.Query(`SELECT slot_id, label, COALESCE(section, ''), duration, song_id, "order" FROM setlist_template_slots WHERE template_id = $1 ORDER BY "order", slot_id`, templateID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	slots := make([]TemplateSlot, 0)
+	for rows.Next() {
+		var slot TemplateSlot
+		if err := rows.Scan(&slot.SlotID, &slot.Label, &slot.Section, &slot.Duration, &slot.SongID, &slot.Order); err != nil {
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+
+	return slots, rows.Err()
+}
+
+// insertTemplateSlots adds slots to a setlist template. Slots without an order keep the order they were given in.
+func insertTemplateSlots(tx *sql.Tx, templateID int64, slots []TemplateSlot) error {
+	for i, slot := range slots {
+		if slot.Order == 0 {
+			slot.Order = int64(i + 1)
+		}
+		if _, err := tx.Exec(`INSERT INTO setlist_template_slots(template_id, label, section, duration, song_id, "order") VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)`,
+			templateID, slot.Label, slot.Section, slot.Duration, slot.SongID, slot.Order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSetlistTemplate verifies a setlist template and its slots. It returns an error message for the client if they are not allowed.
+func checkSetlistTemplate(template *SetlistTemplate, collectionID int64) (string, error) {
+	if template.Name == "" {
+		return `{"error": "No template name supplied."}`, nil
+	}
+
+	if (template.Gap != nil && *template.Gap < 0) || (template.TargetLength != nil && *template.TargetLength < 0) {
+		return `{"error": "Gap and target length cannot be negative."}`, nil
+	}
+
+	songIDs := make([]int64, 0)
+	for _, slot := range template.Slots {
+		if slot.Label == "" {
+			return `{"error": "Every slot needs a label."}`, nil
+		}
+		if slot.Duration != nil && *slot.Duration < 0 {
+			return `{"error": "Duration cannot be negative."}`, nil
+		}
+		if slot.SongID != nil {
+			songIDs = append(songIDs, *slot.SongID)
+		}
+	}
+
+	return checkCollectionSongs(songIDs, collectionID)
+}
+
+// checkCollectionSongs verifies that songs are in a collection. It returns an error message for the client if any are not.
+func checkCollectionSongs(songIDs []int64, collectionID int64) (string, error) {
+	songIDs = uniqueIDs(songIDs)
+	if len(songIDs) == 0 {
+		return "", nil
+	}
+
+	var songs int
+	if err := db.QueryRow("SELECT count(*) FROM songs WHERE collection_id = $1 AND song_id = ANY($2)", collectionID, pq.Array(songIDs)).Scan(&songs); err != nil {
+		return "", err
+	}
+
+	if songs != len(songIDs) {
+		return fmt.Sprintf(`{"error": "%d songs were not found in this collection."}`, len(songIDs)-songs), nil
+	}
+	return "", nil
+}
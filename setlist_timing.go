@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+)
+
+// getSetlistPlan gets the items of a setlist grouped by section, with the start offset of each item,
+// along with the total runtime in seconds and any warnings about the timing of the setlist.
+func getSetlistPlan(setlistID int64) ([]SetlistSection, int64, []string, error) {
+	var gap int64
+	var targetLength *int64
+	if err := db.QueryRow("SELECT gap, target_length FROM setlists WHERE setlist_id = $1", setlistID).Scan(&gap, &targetLength); err != nil {
+		return nil, 0, nil, err
+	}
+
+	items, err := getSetlistItems(setlistID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	sections, err := getSetlistSections(setlistID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	sections = groupSetlistItems(sections, items)
+	runtime, untimed := timeSetlist(sections, gap)
+	return sections, runtime, setlistWarnings(runtime, targetLength, untimed), nil
+}
+
+// timeSetlist sets the start offset of each item in the order they are performed, with a gap between items.
+// It returns the total runtime in seconds, and how many items have no duration and were counted as zero.
+func timeSetlist(sections []SetlistSection, gap int64) (int64, int64) {
+	var runtime, untimed int64
+	first := true
+	for i := range sections {
+		for j := range sections[i].Items {
+			item := &sections[i].Items[j]
+			if !first {
+				runtime += gap
+			}
+			first = false
+
+			start := runtime
+			item.Start = &start
+			if item.Duration == nil {
+				untimed++
+				continue
+			}
+			runtime += *item.Duration
+		}
+	}
+
+	return runtime, untimed
+}
+
+// setlistWarnings warns when a setlist runs longer than its target length, or when the runtime is incomplete
+func setlistWarnings(runtime int64, targetLength *int64, untimed int64) []string {
+	warnings := make([]string, 0)
+	if targetLength != nil && runtime > *targetLength {
+		warnings = append(warnings, fmt.Sprintf("The setlist runs %s, which is %s over the target length of %s.",
+			formatDuration(runtime), formatDuration(runtime-*targetLength), formatDuration(*targetLength)))
+	}
+
+	if untimed == 1 {
+		warnings = append(warnings, "1 item has no duration, so the runtime may be longer.")
+	} else if untimed > 1 {
+		warnings = append(warnings, fmt.Sprintf("%d items have no duration, so the runtime may be longer.", untimed))
+	}
+
+	return warnings
+}
+
+// formatDuration formats seconds as m:ss, or h:mm:ss for an hour or more
+func formatDuration(seconds int64) string {
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
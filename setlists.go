@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/dchest/uniuri"
 	"github.com/gorilla/mux"
@@ -23,12 +24,54 @@ type Setlist struct {
 	Notes     string     `json:"notes,omitempty"`
 	Shared    bool       `json:"shared"`
 	ShareCode *string    `json:"share_code,omitempty"`
+	// PublicDetails shows entry notes, keys, instructions and performers in the public view.
+	// It is left unchanged by an update that doesn't include it.
+	PublicDetails *bool `json:"public_details,omitempty"`
+
+	// Timing plan in seconds. Gap is the time between pieces. A target length of 0 removes it.
+	Gap          *int64   `json:"gap,omitempty"`
+	TargetLength *int64   `json:"target_length,omitempty"`
+	Runtime      *int64   `json:"runtime,omitempty"`
+	Warnings     []string `json:"warnings,omitempty"`
+
+	// Who owns the setlist, and what the current user is allowed to do with it: view, edit or owner
+	OwnerID *int64 `json:"owner_id,omitempty"`
+	Owner   string `json:"owner,omitempty"`
+	Access  string `json:"access,omitempty"`
+}
+
+// SetlistItem is a struct that models an entry in a setlist, both in the request body, and in the DB.
+// An item is either a song, or free text such as Announcements with an optional duration.
+type SetlistItem struct {
+	ItemID    int64      `json:"item_id"`
+	SongID    *int64     `json:"song_id,omitempty"`
+	Name      string     `json:"name"`
+	Artist    string     `json:"artist,omitempty"`
+	Arranger  string     `json:"arranger,omitempty"`
+	DateAdded *time.Time `json:"date_added,omitempty"`
+	Duration  *int64     `json:"duration,omitempty"` // In seconds. Song items use the song's duration unless set on the item.
+	Start     *int64     `json:"start,omitempty"`    // Seconds from the start of the setlist
+	Order     int64      `json:"order"`
+	SectionID *int64     `json:"section_id,omitempty"`
+
+	// How the song is performed this time
+	Notes       string             `json:"notes,omitempty"`
+	Key         string             `json:"key,omitempty"`
+	Instruction string             `json:"instruction,omitempty"`
+	Performers  []SetlistPerformer `json:"performers,omitempty"`
+}
+
+// SetlistPerformer is a collection member assigned to perform a setlist item, such as a soloist
+type SetlistPerformer struct {
+	UserID int64  `json:"user_id"`
+	Name   string `json:"name,omitempty"`
 }
 
 // ReorderRequest is a struct that modes a request to reorder a setlist
 type ReorderRequest struct {
-	SongID int64 `json:"song_id"`
-	Order  int64 `json:"order"`
+	ItemID    int64  `json:"item_id"`
+	Order     int64  `json:"order"`
+	SectionID *int64 `json:"section_id"`
 }
 
 // SetlistsHandler handles GETting all of the user's setlists and POSTing a new setlist.
@@ -51,7 +94,10 @@ func SetlistsHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		// Get a list of all user's setlists in this collection
-		rows, err := db.Query("SELECT setlist_id, name, date, notes FROM setlists WHERE collection_id = $2 AND (user_id = $1 OR shared = true)", session.Values["user_id"], collectionID)
+		rows, err := db.Query(`
+			SELECT setlist_id, name, date, notes FROM setlists
+			WHERE collection_id = $2
+			  AND (user_id = $1 OR shared = true OR setlist_id IN (SELECT setlist_id FROM setlist_collaborators WHERE user_id = $1))`, session.Values["user_id"], collectionID)
 		if err != nil {
 			log.Printf("Setlists GET - Unable to retrieve setlists from database: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
@@ -147,12 +193,37 @@ func SetlistHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		// Find the setlist in the database
-		if err := db.QueryRow("SELECT setlist_id, name, date, notes, shared, share_code FROM setlists WHERE setlist_id = $1 AND (user_id = $2 OR shared = true)", setlistID, session.Values["user_id"]).Scan(&setlist.SetlistID, &setlist.Name, &setlist.Date, &setlist.Notes, &setlist.Shared, &setlist.ShareCode); err != nil {
+		if err := db.QueryRow(`
+			SELECT setlist_id, setlists.name, date, notes, shared, share_code, public_details, gap, target_length, setlists.user_id, users.name
+			FROM setlists JOIN users ON users.user_id = setlists.user_id
+			WHERE setlist_id = $1 AND collection_id = $2`, setlistID, collectionID).Scan(&setlist.SetlistID, &setlist.Name, &setlist.Date, &setlist.Notes, &setlist.Shared, &setlist.ShareCode, &setlist.PublicDetails, &setlist.Gap, &setlist.TargetLength, &setlist.OwnerID, &setlist.Owner); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+				return
+			}
 			log.Printf("Setlist GET - Unable to get setlist from database: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 
+		access, err := getSetlistAccess(setlistID, session.Values["user_id"].(int64))
+		if err != nil {
+			log.Printf("Setlist GET - Unable to get access to setlist: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		setlist.Access = setlistAccessNames[access]
+
+		// Work out how long the setlist runs
+		_, runtime, warnings, err := getSetlistPlan(setlistID)
+		if err != nil {
+			log.Printf("Setlist GET - Unable to get setlist runtime: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		setlist.Runtime = &runtime
+		setlist.Warnings = warnings
+
 		// Send response
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -171,11 +242,17 @@ func SetlistHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Update setlist in database
+		if (setlist.Gap != nil && *setlist.Gap < 0) || (setlist.TargetLength != nil && *setlist.TargetLength < 0) {
+			SendError(w, `{"error": "Gap and target length cannot be negative."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Update setlist in database. Editors are checked by VerifySetlistID.
 		var result sql.Result
 		// log.Printf("SetlistID: %d\tCollectionID: %d\tUserID: %d\n", setlistID, collectionID, session.Values["user_id"])
 		// log.Printf("Name: %s\tDate: %s\tNotes: %s\n", setlist.Name, setlist.Date, setlist.Notes)
-		if result, err = db.Exec("UPDATE setlists SET name = $1, date = $2, notes = $3 WHERE setlist_id = $4 AND collection_id = $5 AND user_id = $6", setlist.Name, setlist.Date, setlist.Notes, setlistID, collectionID, session.Values["user_id"]); err != nil {
+		if result, err = db.Exec("UPDATE setlists SET name = $1, date = $2, notes = $3, public_details = COALESCE($6, public_details), gap = COALESCE($7, gap), target_length = NULLIF(COALESCE($8, target_length), 0) WHERE setlist_id = $4 AND collection_id = $5",
+			setlist.Name, setlist.Date, setlist.Notes, setlistID, collectionID, setlist.PublicDetails, setlist.Gap, setlist.TargetLength); err != nil {
 			log.Printf("Setlist PUT - Unable to update setlist in database: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
@@ -198,6 +275,16 @@ func SetlistHandler(w http.ResponseWriter, r *http.Request) {
 		return
 
 	} else if r.Method == "DELETE" {
+		// Only the owner can delete a setlist
+		if access, err := getSetlistAccess(setlistID, session.Values["user_id"].(int64)); err != nil {
+			log.Printf("Setlist DELETE - Unable to get access to setlist: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if access < setlistOwnerAccess {
+			SendError(w, `{"error": "Only the owner of this setlist can delete it."}`, http.StatusForbidden)
+			return
+		}
+
 		// Start db transaction
 		tx, err := db.Begin()
 		if err != nil {
@@ -269,6 +356,16 @@ func SetlistVisibilityHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "PUT" {
+		// Only the owner can change who can see a setlist
+		if access, err := getSetlistAccess(setlistID, session.Values["user_id"].(int64)); err != nil {
+			log.Printf("Setlist Visibility PUT - Unable to get access to setlist: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if access < setlistOwnerAccess {
+			SendError(w, `{"error": "Only the owner of this setlist can change its visibility."}`, http.StatusForbidden)
+			return
+		}
+
 		var visibility string
 
 		if result, err := ioutil.ReadAll(r.Body); err != nil {
@@ -291,25 +388,22 @@ func SetlistVisibilityHandler(w http.ResponseWriter, r *http.Request) {
 		// 	return
 		// }
 
-		var result sql.Result
+		var shared bool
 		var shareCode string
 
 		switch strings.ToLower(visibility) {
 		case "private":
 			// Remove all sharing
-			result, err = db.Exec("UPDATE setlists SET shared = false, share_code = NULL WHERE setlist_id = $1 AND collection_id = $2 AND user_id = $3", setlistID, collectionID, session.Values["user_id"])
-			break
+			shared = false
 
 		case "collection":
 			// Share with only collection members
-			result, err = db.Exec("UPDATE setlists SET shared = true, share_code = NULL WHERE setlist_id = $1 AND collection_id = $2 AND user_id = $3", setlistID, collectionID, session.Values["user_id"])
-			break
+			shared = true
 
 		case "public":
 			// Share with anybody
+			shared = true
 			shareCode = uniuri.New()
-			result, err = db.Exec("UPDATE setlists SET shared = true, share_code = $1 WHERE setlist_id = $2 AND collection_id = $3 AND user_id = $4", shareCode, setlistID, collectionID, session.Values["user_id"])
-			break
 
 		default:
 			// Not a known visibility value
@@ -318,9 +412,22 @@ func SetlistVisibilityHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Check for errors during update
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Setlist Visibility PUT - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// A new share link doesn't keep the expiration or password of the previous one
+		result, err := tx.Exec("UPDATE setlists SET shared = $1, share_code = NULLIF($2, ''), share_expires = NULL, share_password = NULL, share_password_changed = NULL WHERE setlist_id = $3 AND collection_id = $4 AND user_id = $5",
+			shared, shareCode, setlistID, collectionID, session.Values["user_id"])
 		if err != nil {
 			log.Printf("Setlist Visibility PUT - Unable to update setlist in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Visibility PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
@@ -329,16 +436,37 @@ func SetlistVisibilityHandler(w http.ResponseWriter, r *http.Request) {
 		rowsAffected, err := result.RowsAffected()
 		if err != nil {
 			log.Printf("Setlist Visibility PUT - Unable to get rows affected by UPDATE: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Visibility PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 
 		if rowsAffected == 0 {
 			log.Printf("Setlist Visibility PUT - No rows updated for UPDATE query.\n")
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Visibility PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
 			SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
 			return
 		}
 
+		if err = replaceShareLink(tx, setlistID, shareCode); err != nil {
+			log.Printf("Setlist Visibility PUT - Unable to update share link history: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Visibility PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Setlist Visibility PUT - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 		if visibility == "public" {
 			w.Header().Add("Content-Type", "application/json")
@@ -390,28 +518,10 @@ func SetlistSongsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "GET" {
-		// Retrieve songs in setlist
-		rows, err := db.Query("SELECT songs.song_id, songs.name, songs.date_added, setlist_songs.order FROM songs JOIN setlist_songs ON songs.song_id = setlist_songs.song_id WHERE collection_id = $1 AND setlist_id = $2", collectionID, setlistID)
+		// Retrieve songs in setlist, grouped by section with their start times
+		sections, _, _, err := getSetlistPlan(setlistID)
 		if err != nil {
-			log.Printf("SetlistSongs GET - Unable to get songs in setlist %v from database: %v\n", setlistID, err)
-			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		// Retrieve rows from database
-		songs := make([]Song, 0)
-		for rows.Next() {
-			var song Song
-			if err := rows.Scan(&song.SongID, &song.Name, &song.DateAdded, &song.Order); err != nil {
-				log.Printf("SetlistSongs GET - Unable to get song data from database result: %v\n", err)
-			}
-			songs = append(songs, song)
-		}
-
-		// Check for errors from iterating over rows.
-		if err := rows.Err(); err != nil {
-			log.Printf("SetlistSongs GET - Unable to get songs from database: %v\n", err)
+			log.Printf("SetlistSongs GET - Unable to get items in setlist %v from database: %v\n", setlistID, err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
@@ -419,7 +529,7 @@ func SetlistSongsHandler(w http.ResponseWriter, r *http.Request) {
 		// Send response
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(songs)
+		json.NewEncoder(w).Encode(sections)
 		return
 
 	} else if r.Method == "POST" {
@@ -441,6 +551,27 @@ func SetlistSongsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Songs can be added straight into a section
+		var sectionID *int64
+		if sectionParameter := r.URL.Query().Get("section_id"); sectionParameter != "" {
+			id, err := strconv.ParseInt(sectionParameter, 10, 64)
+			if err != nil {
+				log.Printf("Setlists Songs POST - Unable to parse section id '%v': %v\n", sectionParameter, err)
+				SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+				return
+			}
+
+			if sectionFound, err := setlistSectionExists(id, setlistID); err != nil {
+				log.Printf("Setlists Songs POST - Unable to verify section: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			} else if !sectionFound {
+				SendError(w, `{"error": "Section not found."}`, http.StatusNotFound)
+				return
+			}
+			sectionID = &id
+		}
+
 		// Start database transaction
 		tx, err := db.Begin()
 		if err != nil {
@@ -449,15 +580,23 @@ func SetlistSongsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		stmt, err := tx.Prepare(pq.CopyIn("setlist_songs", "setlist_id", "song_id"))
+		// New songs go at the end of the setlist. The same song can be added more than once.
+		var lastOrder int64
+		if err = tx.QueryRow(`SELECT COALESCE(max("order"), 0) FROM setlist_songs WHERE setlist_id = $1`, setlistID).Scan(&lastOrder); err != nil {
+			log.Printf("Setlists Songs POST - Unable to get last song order: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		stmt, err := tx.Prepare(pq.CopyIn("setlist_songs", "setlist_id", "song_id", "section_id", "order"))
 		if err != nil {
 			log.Printf("Setlists Songs POST - Unable to prepare statement: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 
-		for _, songID := range songs {
-			_, err = stmt.Exec(setlistID, songID)
+		for i, songID := range songs {
+			_, err = stmt.Exec(setlistID, songID, sectionID, lastOrder+int64(i)+1)
 			if err != nil {
 				log.Printf("Setlists Songs POST - Unable to add song ID to prepared statement: %v\n", err)
 			}
@@ -513,7 +652,11 @@ func SetlistSongsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Prepare bulk statement
-		stmt, err := tx.Prepare(`UPDATE setlist_songs SET "order" = $1 WHERE setlist_id = $2 AND song_id = $3`)
+		// Songs can also move between sections of this setlist
+		stmt, err := tx.Prepare(`
+			UPDATE setlist_songs SET "order" = $1, section_id = $2
+			WHERE setlist_id = $3 AND item_id = $4
+			  AND ($2::integer IS NULL OR $2 IN (SELECT section_id FROM setlist_sections WHERE setlist_id = $3))`)
 		if err != nil {
 			log.Printf("Setlists Songs PUT - Unable to prepare statement: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
@@ -521,9 +664,9 @@ func SetlistSongsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		for _, order := range songs {
-			_, err = stmt.Exec(order.Order, setlistID, order.SongID)
+			_, err = stmt.Exec(order.Order, order.SectionID, setlistID, order.ItemID)
 			if err != nil {
-				log.Printf("Setlists Songs PUT - Unable to add song ID and order to prepared statement: %v\n", err)
+				log.Printf("Setlists Songs PUT - Unable to add item ID and order to prepared statement: %v\n", err)
 			}
 		}
 
@@ -552,7 +695,93 @@ func SetlistSongsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// SetlistSongHandler manages a single song within a setlist
+// SetlistItemsHandler handles POSTing a free text item, such as Announcements or Intermission, to a setlist
+func SetlistItemsHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Items handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	setlistID, err := strconv.ParseInt(mux.Vars(r)["setlist_id"], 10, 64)
+	if err != nil {
+		log.Printf("Setlist Items handler - Unable to parse setlist_id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	// Verify Setlist ID
+	var actualCollectionID int64
+	if err = db.QueryRow("SELECT collection_id FROM setlists WHERE setlist_id = $1", setlistID).Scan(&actualCollectionID); err != nil || actualCollectionID != collectionID {
+		log.Printf("Setlist Items handler - Setlist %d not found in collection %d: %v\n", setlistID, collectionID, err)
+		SendError(w, `{"error": "Setlist not found."}`, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "POST" {
+		var item SetlistItem
+		if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Items POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if item.Name == "" {
+			SendError(w, `{"error": "No item text supplied."}`, http.StatusBadRequest)
+			return
+		}
+
+		if item.Duration != nil && *item.Duration < 0 {
+			SendError(w, `{"error": "Duration cannot be negative."}`, http.StatusBadRequest)
+			return
+		}
+
+		if utf8.RuneCountInString(item.Instruction) > 255 {
+			SendError(w, `{"error": "Instruction must be 255 characters or less."}`, http.StatusBadRequest)
+			return
+		}
+
+		if item.SectionID != nil {
+			if sectionFound, err := setlistSectionExists(*item.SectionID, setlistID); err != nil {
+				log.Printf("Setlist Items POST - Unable to verify section: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			} else if !sectionFound {
+				SendError(w, `{"error": "Section not found."}`, http.StatusNotFound)
+				return
+			}
+		}
+
+		// New items go at the end of the setlist unless an order is given.
+		// Performers and keys are only assigned to songs.
+		item.SongID = nil
+		item.Key = ""
+		item.Performers = nil
+		if err = db.QueryRow(`
+			INSERT INTO setlist_songs(setlist_id, title, duration, section_id, "order", notes, instruction)
+			VALUES ($1, $2, $3, $4, CASE WHEN $5 = 0 THEN (SELECT COALESCE(max("order"), 0) + 1 FROM setlist_songs WHERE setlist_id = $1) ELSE $5 END, $6, $7)
+			RETURNING item_id, "order"`, setlistID, item.Name, item.Duration, item.SectionID, item.Order, item.Notes, item.Instruction).Scan(&item.ItemID, &item.Order); err != nil {
+			log.Printf("Setlist Items POST - Unable to insert item in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(item)
+		return
+	}
+}
+
+// SetlistSongHandler manages a single item within a setlist.
+// Updating an item only changes the fields in the request. Send a null duration to use the song's own duration again.
 func SetlistSongHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
 
@@ -579,10 +808,10 @@ func SetlistSongHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get song ID from URL
-	songID, err := strconv.ParseInt(mux.Vars(r)["song_id"], 10, 64)
+	// Get item ID from URL
+	itemID, err := strconv.ParseInt(mux.Vars(r)["item_id"], 10, 64)
 	if err != nil {
-		log.Printf("Setlist Song handler - Unable to parse song_id from URL: %v\n", err)
+		log.Printf("Setlist Song handler - Unable to parse item_id from URL: %v\n", err)
 		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
 		return
 	}
@@ -601,10 +830,147 @@ func SetlistSongHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Method == "DELETE" {
-		// Delete setlist song from database
+	if r.Method == "PUT" {
+		// Start from the current item so fields left out of the request are kept
+		var item SetlistItem
+		var songID, songDuration *int64
+		if err = db.QueryRow(`
+			SELECT setlist_songs.song_id, COALESCE(setlist_songs.title, ''), setlist_songs.duration, songs.duration,
+			       COALESCE(setlist_songs.notes, ''), COALESCE(setlist_songs.performance_key, ''), COALESCE(setlist_songs.instruction, '')
+			FROM setlist_songs
+			LEFT JOIN songs ON songs.song_id = setlist_songs.song_id
+			WHERE setlist_songs.item_id = $1 AND setlist_songs.setlist_id = $2`, itemID, setlistID).Scan(
+			&songID, &item.Name, &item.Duration, &songDuration, &item.Notes, &item.Key, &item.Instruction); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Setlist item not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Setlist Song PUT - Unable to get setlist item from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Setlist Song PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		if item.Duration != nil && *item.Duration < 0 {
+			SendError(w, `{"error": "Duration cannot be negative."}`, http.StatusBadRequest)
+			return
+		}
+
+		// A song item sent back with its song's own duration isn't an override
+		if songID != nil && item.Duration != nil && songDuration != nil && *item.Duration == *songDuration {
+			item.Duration = nil
+		}
+
+		// Only free text items have their own text
+		if songID == nil && item.Name == "" {
+			SendError(w, `{"error": "No item text supplied."}`, http.StatusBadRequest)
+			return
+		}
+
+		if utf8.RuneCountInString(item.Key) > 15 {
+			SendError(w, `{"error": "Key must be 15 characters or less."}`, http.StatusBadRequest)
+			return
+		}
+
+		if utf8.RuneCountInString(item.Instruction) > 255 {
+			SendError(w, `{"error": "Instruction must be 255 characters or less."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Performers are only replaced when they are in the request
+		replacePerformers := item.Performers != nil
+		if replacePerformers && songID == nil && len(item.Performers) > 0 {
+			SendError(w, `{"error": "Only songs can have performers."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Performers must be members of this collection
+		performers := make([]int64, 0)
+		for _, performer := range item.Performers {
+			performers = append(performers, performer.UserID)
+		}
+		performers = uniqueIDs(performers)
+
+		var members int64
+		if err = db.QueryRow("SELECT count(*) FROM collection_members WHERE collection_id = $1 AND user_id = ANY($2)", collectionID, pq.Array(performers)).Scan(&members); err != nil {
+			log.Printf("Setlist Song PUT - Unable to verify performers: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if members != int64(len(performers)) {
+			SendError(w, `{"error": "Performers must be members of this collection."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Start database transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Setlist Song PUT - Unable to begin transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec(`
+			UPDATE setlist_songs
+			SET title = CASE WHEN song_id IS NULL THEN $1 END, duration = $2, notes = $3, performance_key = $4, instruction = $5
+			WHERE item_id = $6 AND setlist_id = $7`, item.Name, item.Duration, item.Notes, item.Key, item.Instruction, itemID, setlistID); err != nil {
+			log.Printf("Setlist Song PUT - Unable to update setlist item: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Setlist Song PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Replace the assigned performers if they were sent
+		if replacePerformers {
+			if _, err = tx.Exec("DELETE FROM setlist_performers WHERE item_id = $1", itemID); err != nil {
+				log.Printf("Setlist Song PUT - Unable to remove performers: %v\n", err)
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					log.Printf("Setlist Song PUT - Unable to rollback transaction: %v\n", rollbackErr)
+				}
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			if _, err = tx.Exec("INSERT INTO setlist_performers(item_id, user_id) SELECT $1, unnest($2::integer[])", itemID, pq.Array(performers)); err != nil {
+				log.Printf("Setlist Song PUT - Unable to add performers: %v\n", err)
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					log.Printf("Setlist Song PUT - Unable to rollback transaction: %v\n", rollbackErr)
+				}
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Setlist Song PUT - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+
+	} else if r.Method == "DELETE" {
+		// Delete setlist item from database
+		if _, err = db.Exec("DELETE FROM setlist_performers WHERE item_id IN (SELECT item_id FROM setlist_songs WHERE setlist_id = $1 AND item_id = $2)", setlistID, itemID); err != nil {
+			log.Printf("Setlist Song DELETE - Unable to remove performers from setlist item: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
 		var result sql.Result
-		if result, err = db.Exec("DELETE FROM setlist_songs WHERE setlist_id = $1 AND song_id = $2", setlistID, songID); err != nil {
+		if result, err = db.Exec("DELETE FROM setlist_songs WHERE setlist_id = $1 AND item_id = $2", setlistID, itemID); err != nil {
 			log.Printf("Setlist Song DELETE - Unable to remove song from setlist: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
@@ -629,12 +995,48 @@ func SetlistSongHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func deleteSetlist(setlistID int64, tx *sql.Tx) error {
+	// Remove collaborators from setlist
+	if _, err := tx.Exec("DELETE FROM setlist_collaborators WHERE setlist_id = $1", setlistID); err != nil {
+		log.Printf("deleteSetlist - Unable to delete collaborators from setlist: %v\n", err)
+		return err
+	}
+
+	// Remove setlist from events
+	if _, err := tx.Exec("DELETE FROM event_setlists WHERE setlist_id = $1", setlistID); err != nil {
+		log.Printf("deleteSetlist - Unable to delete setlist from events: %v\n", err)
+		return err
+	}
+
+	// Keep rehearsals without the setlist
+	if _, err := tx.Exec("UPDATE rehearsals SET setlist_id = NULL WHERE setlist_id = $1", setlistID); err != nil {
+		log.Printf("deleteSetlist - Unable to remove setlist from rehearsals: %v\n", err)
+		return err
+	}
+
+	// Remove share link history
+	if _, err := tx.Exec("DELETE FROM setlist_share_links WHERE setlist_id = $1", setlistID); err != nil {
+		log.Printf("deleteSetlist - Unable to delete share links from setlist: %v\n", err)
+		return err
+	}
+
+	// Remove performers from setlist songs
+	if _, err := tx.Exec("DELETE FROM setlist_performers WHERE item_id IN (SELECT item_id FROM setlist_songs WHERE setlist_id = $1)", setlistID); err != nil {
+		log.Printf("deleteSetlist - Unable to delete performers from setlist: %v\n", err)
+		return err
+	}
+
 	// Remove songs from setlist
 	if _, err := tx.Exec("DELETE FROM setlist_songs WHERE setlist_id = $1", setlistID); err != nil {
 		log.Printf("deleteSetlist - Unable to delete songs from setlist: %v\n", err)
 		return err
 	}
 
+	// Remove sections from setlist
+	if _, err := tx.Exec("DELETE FROM setlist_sections WHERE setlist_id = $1", setlistID); err != nil {
+		log.Printf("deleteSetlist - Unable to delete sections from setlist: %v\n", err)
+		return err
+	}
+
 	// Delete setlist
 	if _, err := tx.Exec("DELETE FROM setlists WHERE setlist_id = $1", setlistID); err != nil {
 		log.Printf("deleteSetlist - Unable to delete setlist: %v\n", err)
@@ -643,3 +1045,69 @@ func deleteSetlist(setlistID int64, tx *sql.Tx) error {
 
 	return nil
 }
+
+// getSetlistItems gets the items in a setlist in order, with their performers. Song items are named after their song.
+func getSetlistItems(setlistID int64) ([]SetlistItem, error) {
+	rows, err := db.Query(`
+		SELECT setlist_songs.item_id, setlist_songs.song_id, COALESCE(songs.name, setlist_songs.title),
+		       COALESCE(songs.artist, ''), COALESCE(songs.arranger, ''), songs.date_added,
+		       COALESCE(setlist_songs.duration, songs.duration), setlist_songs.order, setlist_songs.section_id,
+		       COALESCE(setlist_songs.notes, ''), COALESCE(setlist_songs.performance_key, ''), COALESCE(setlist_songs.instruction, '')
+		FROM setlist_songs
+		LEFT JOIN songs ON songs.song_id = setlist_songs.song_id
+		WHERE setlist_songs.setlist_id = $1
+		ORDER BY setlist_songs.order, setlist_songs.item_id`, setlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]SetlistItem, 0)
+	itemIndex := make(map[int64]int)
+	for rows.Next() {
+		var item SetlistItem
+		if err := rows.Scan(&item.ItemID, &item.SongID, &item.Name, &item.Artist, &item.Arranger, &item.DateAdded, &item.Duration, &item.Order, &item.SectionID,
+			&item.Notes, &item.Key, &item.Instruction); err != nil {
+			return nil, err
+		}
+		itemIndex[item.ItemID] = len(items)
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Add the performers assigned to each item
+	performerRows, err := db.Query(`
+		SELECT p.item_id, u.user_id, u.name
+		FROM setlist_performers AS p
+		JOIN setlist_songs AS ss ON ss.item_id = p.item_id
+		JOIN users AS u ON u.user_id = p.user_id
+		WHERE ss.setlist_id = $1
+		ORDER BY u.name`, setlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer performerRows.Close()
+
+	for performerRows.Next() {
+		var itemID int64
+		var performer SetlistPerformer
+		if err := performerRows.Scan(&itemID, &performer.UserID, &performer.Name); err != nil {
+			return nil, err
+		}
+		if i, ok := itemIndex[itemID]; ok {
+			items[i].Performers = append(items[i].Performers, performer)
+		}
+	}
+
+	return items, performerRows.Err()
+}
+
+// setlistSectionExists checks if a section belongs to a setlist
+func setlistSectionExists(sectionID, setlistID int64) (bool, error) {
+	var sectionFound bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM setlist_sections WHERE section_id = $1 AND setlist_id = $2)", sectionID, setlistID).Scan(&sectionFound)
+	return sectionFound, err
+}
@@ -53,10 +53,14 @@ type Song struct {
 	SongID        int64      `json:"song_id" db:"song_id"`
 	Name          string     `json:"name" db:"name"`
 	Artist        string     `json:"artist" db:"artist"`
+	Arranger      string     `json:"arranger" db:"arranger"`
 	DateAdded     *time.Time `json:"date_added" db:"date_added"`
 	Location      string     `json:"location" db:"location"`
 	LastPerformed *string    `json:"last_performed,omitempty" db:"last_performed"`
 	Notes         string     `json:"notes" db:"notes"`
+	Key           string     `json:"key" db:"key"`
+	Voicing       string     `json:"voicing" db:"voicing"`
+	Duration      *int64     `json:"duration,omitempty" db:"duration"` // Length of the song in seconds
 	AddedBy       string     `json:"added_by" db:"added_by"`
 	CollectionID  int64      `json:"collection_id" db:"collection_id"`
 
@@ -70,6 +74,22 @@ type TaggedSong struct {
 	SongID int64 `json:"song_id" db:"song_id"`
 }
 
+// BulkTagRequest models the request body for adding and removing tags on many songs at once.
+// The songs are given by ID, by a search query, or both.
+type BulkTagRequest struct {
+	SongIDs    []int64 `json:"song_ids"`
+	Query      string  `json:"query"`
+	AddTags    []int64 `json:"add_tags"`
+	RemoveTags []int64 `json:"remove_tags"`
+}
+
+// BulkTagResult reports what a bulk tag request changed
+type BulkTagResult struct {
+	SongsChanged int64 `json:"songs_changed"`
+	TagsAdded    int64 `json:"tags_added"`
+	TagsRemoved  int64 `json:"tags_removed"`
+}
+
 // SongsHandler handles GETting all songs and POSTing a new song
 func SongsHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := store.Get(r, "session")
@@ -102,16 +122,56 @@ func SongsHandler(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Songs GET - Excluded tags: %v\n", excludedTags)
 		}
 
+		// Saved searches can be used like tags to include or exclude songs
+		var includedSearches, excludedSearches []int64
+		if queryString = r.URL.Query().Get("include_searches"); len(queryString) > 0 {
+			if err := json.Unmarshal([]byte(queryString), &includedSearches); err != nil {
+				log.Printf("Songs GET - Unable to get list of included saved searches from query string: %v\n", err)
+				SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+				return
+			}
+		}
+		if queryString = r.URL.Query().Get("exclude_searches"); len(queryString) > 0 {
+			if err := json.Unmarshal([]byte(queryString), &excludedSearches); err != nil {
+				log.Printf("Songs GET - Unable to get list of excluded saved searches from query string: %v\n", err)
+				SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+				return
+			}
+		}
+
+		includedSongs, err := savedSearchSongIDs(includedSearches, int64(collectionID), session.Values["user_id"].(int64))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Saved search not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Songs GET - Unable to run included saved searches: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		excludedSongs, err := savedSearchSongIDs(excludedSearches, int64(collectionID), session.Values["user_id"].(int64))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Saved search not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Songs GET - Unable to run excluded saved searches: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
 		// Retrieve songs in collection
-		// rows, err := db.Query("SELECT song_id, name, date_added FROM songs WHERE collection_id = $1", collectionID)
 		rows, err := db.Query(`
 			SELECT s.song_id, s.name, s.date_added 
 			FROM songs AS s 
 			LEFT JOIN tagged_songs AS ts 
 				ON s.song_id = ts.song_id 
-			   AND ts.tag_id = ANY($2) 
+			   AND ts.tag_id IN (SELECT tag_id FROM tag_ancestors WHERE ancestor_id = ANY($2)) 
 			WHERE s.collection_id = $1 
-			AND ts.tag_id IS NULL`, collectionID, pq.Array(excludedTags))
+			AND ts.tag_id IS NULL
+			AND ($3::integer[] IS NULL OR s.song_id = ANY($3))
+			AND ($4::integer[] IS NULL OR s.song_id <> ALL($4))`, collectionID, pq.Array(excludedTags), pq.Array(includedSongs), pq.Array(excludedSongs))
 		if err != nil {
 			log.Printf("Songs GET - Unable to get songs from database: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
@@ -161,15 +221,25 @@ func SongsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if song.Duration != nil && *song.Duration < 0 {
+			SendError(w, `{"error": "Duration cannot be negative."}`, http.StatusBadRequest)
+			return
+		}
+
 		// Create collection in database
 		var songID int64
-		if err = db.QueryRow("INSERT INTO songs(name, artist, location, last_performed, notes, added_by, collection_id) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING song_id",
-			song.Name, song.Artist, song.Location, song.LastPerformed, song.Notes, session.Values["user_id"], collectionID).Scan(&songID); err != nil {
+		if err = db.QueryRow("INSERT INTO songs(name, artist, arranger, location, last_performed, notes, key, voicing, duration, added_by, collection_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING song_id",
+			song.Name, song.Artist, song.Arranger, song.Location, song.LastPerformed, song.Notes, song.Key, song.Voicing, song.Duration, session.Values["user_id"], collectionID).Scan(&songID); err != nil {
 			log.Printf("Songs POST - Unable to insert song record in database: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 
+		// Apply the collection's tagging rules to the new song
+		if _, err = applyTagRulesNow(int64(collectionID), []int64{songID}); err != nil {
+			log.Printf("Songs POST - Unable to apply tag rules to song %d: %v\n", songID, err)
+		}
+
 		// Send response
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -212,7 +282,7 @@ func SongHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		// Find the song in the database
-		if err = db.QueryRow("SELECT songs.name, artist, location, last_performed, date_added, users.name, notes FROM songs JOIN users ON added_by = user_id WHERE collection_id = $1 AND songs.song_id = $2", song.CollectionID, song.SongID).Scan(&song.Name, &song.Artist, &song.Location, &song.LastPerformed, &song.DateAdded, &song.AddedBy, &song.Notes); err != nil {
+		if err = db.QueryRow("SELECT songs.name, artist, COALESCE(arranger, ''), location, last_performed, date_added, users.name, notes, COALESCE(key, ''), COALESCE(voicing, ''), duration FROM songs JOIN users ON added_by = user_id WHERE collection_id = $1 AND songs.song_id = $2", song.CollectionID, song.SongID).Scan(&song.Name, &song.Artist, &song.Arranger, &song.Location, &song.LastPerformed, &song.DateAdded, &song.AddedBy, &song.Notes, &song.Key, &song.Voicing, &song.Duration); err != nil {
 			if err == sql.ErrNoRows {
 				w.WriteHeader(http.StatusNotFound)
 			} else {
@@ -241,16 +311,26 @@ func SongHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if song.Duration != nil && *song.Duration < 0 {
+			SendError(w, `{"error": "Duration cannot be negative."}`, http.StatusBadRequest)
+			return
+		}
+
 		// Update song in database
 		if *song.LastPerformed == "" {
 			song.LastPerformed = nil
 		}
-		if _, err = db.Exec("UPDATE songs SET artist = $1, location = $2, last_performed = $3, notes = $4, name = $5 WHERE collection_id = $6 AND song_id = $7", song.Artist, song.Location, song.LastPerformed, song.Notes, song.Name, collectionID, song.SongID); err != nil {
+		if _, err = db.Exec("UPDATE songs SET artist = $1, location = $2, last_performed = $3, notes = $4, name = $5, key = $6, voicing = $7, duration = $8, arranger = $9 WHERE collection_id = $10 AND song_id = $11", song.Artist, song.Location, song.LastPerformed, song.Notes, song.Name, song.Key, song.Voicing, song.Duration, song.Arranger, collectionID, song.SongID); err != nil {
 			log.Printf("Song PUT - Unable to update song in database: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 
+		// The song's changes may match different tagging rules
+		if _, err = applyTagRulesNow(collectionID, []int64{song.SongID}); err != nil {
+			log.Printf("Song PUT - Unable to apply tag rules to song %d: %v\n", song.SongID, err)
+		}
+
 		w.WriteHeader(http.StatusOK)
 		return
 	} else if r.Method == "DELETE" {
@@ -268,6 +348,27 @@ func SongHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Templates no longer suggest this song
+		if _, err = tx.Exec("UPDATE setlist_template_slots SET song_id = NULL WHERE song_id = $1", song.SongID); err != nil {
+			log.Printf("Song DELETE - Unable to remove song from setlist templates: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Remove performance history
+		if _, err = tx.Exec("DELETE FROM song_performances WHERE song_id = $1", song.SongID); err != nil {
+			log.Printf("Song DELETE - Unable to remove song performances from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Remove song from rehearsals
+		if _, err = tx.Exec("DELETE FROM rehearsal_songs WHERE song_id = $1", song.SongID); err != nil {
+			log.Printf("Song DELETE - Unable to remove song from rehearsals: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
 		// Delete song
 		var result sql.Result
 		if result, err = tx.Exec("DELETE FROM songs WHERE collection_id = $1 AND song_id = $2", song.CollectionID, song.SongID); err != nil {
@@ -331,7 +432,12 @@ func SongTagsHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		// Find the song in the database
-		if rows, err = db.Query("SELECT tags.tag_id, name, description FROM tags JOIN tagged_songs ON tags.tag_id = tagged_songs.tag_id WHERE collection_id = $1 AND song_id = $2", collectionID, songID); err != nil {
+		if rows, err = db.Query(`
+			SELECT tags.tag_id, tags.name, description, COALESCE(color, ''), COALESCE(icon, ''), tags.category_id, COALESCE(tag_categories.name, ''), rule_id
+			FROM tags
+			JOIN tagged_songs ON tags.tag_id = tagged_songs.tag_id
+			LEFT JOIN tag_categories ON tag_categories.category_id = tags.category_id
+			WHERE tags.collection_id = $1 AND song_id = $2`, collectionID, songID); err != nil {
 			if err != sql.ErrNoRows {
 				log.Printf("Tagged song GET - Unable to get tagged songs from database: %v\n", err)
 				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
@@ -341,7 +447,7 @@ func SongTagsHandler(w http.ResponseWriter, r *http.Request) {
 
 		for rows.Next() {
 			var tag Tag
-			if err = rows.Scan(&tag.TagID, &tag.Name, &tag.Description); err != nil {
+			if err = rows.Scan(&tag.TagID, &tag.Name, &tag.Description, &tag.Color, &tag.Icon, &tag.CategoryID, &tag.Category, &tag.RuleID); err != nil {
 				log.Printf("Tagged song GET - Unable to parse tagged song from database: %v\n", err)
 				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			}
@@ -394,9 +500,19 @@ func SongTagsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Single select categories allow only one of their tags per song
+		if message, err := checkSingleSelect(songID, taggedSong.TagID); err != nil {
+			log.Printf("Tagged song POST - Unable to check tag category: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
 		// Create song tag in database
 		if _, err = db.Exec("INSERT INTO tagged_songs(tag_id, song_id) VALUES ($1, $2)",
-			taggedSong.TagID, taggedSong.SongID); err != nil {
+			taggedSong.TagID, songID); err != nil {
 			if err.(*pq.Error).Code == "23505" {
 				// Song is already tagged with this tag
 				SendError(w, `{"error": "Song already has this tag."}`, http.StatusBadRequest)
@@ -459,3 +575,193 @@ func SongTagsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// BulkSongTagsHandler handles adding and removing a set of tags across a set of songs in one transaction.
+func BulkSongTagsHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Bulk Song Tags handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		var request BulkTagRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Bulk Song Tags POST - Unable to parse request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		if len(request.AddTags) == 0 && len(request.RemoveTags) == 0 {
+			SendError(w, `{"error": "No tags to add or remove."}`, http.StatusBadRequest)
+			return
+		}
+
+		// A tag listed twice would look like two tags from the same single select category
+		request.AddTags = uniqueIDs(request.AddTags)
+		request.RemoveTags = uniqueIDs(request.RemoveTags)
+
+		// Add the songs matching the search
+		songIDs := request.SongIDs
+		if request.Query != "" {
+			parsedQuery, err := parseSearchQuery(request.Query)
+			if err != nil {
+				log.Printf("Bulk Song Tags POST - Unable to parse search query '%v': %v\n", request.Query, err)
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(err)
+				return
+			}
+
+			results, err := searchCollections([]int64{collectionID}, compileSearchQuery(parsedQuery, 2, false))
+			if err != nil {
+				log.Printf("Bulk Song Tags POST - Unable to search collection: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			for _, result := range results {
+				songIDs = append(songIDs, result.SongID)
+			}
+		}
+
+		// Every tag must be in this collection
+		tagIDs := append(append([]int64{}, request.AddTags...), request.RemoveTags...)
+		var tagsFound int
+		if err = db.QueryRow("SELECT count(*) FROM tags WHERE tag_id = ANY($1) AND collection_id = $2", pq.Array(tagIDs), collectionID).Scan(&tagsFound); err != nil {
+			log.Printf("Bulk Song Tags POST - Unable to verify tags: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if tagsFound != len(uniqueIDs(tagIDs)) {
+			SendError(w, `{"error": "Tag not found."}`, http.StatusNotFound)
+			return
+		}
+
+		// Two tags from the same single select category can't both be added
+		var sameCategory bool
+		if err = db.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1
+				FROM tags AS t
+				JOIN tag_categories AS c ON c.category_id = t.category_id AND c.single_select
+				WHERE t.tag_id = ANY($1)
+				GROUP BY t.category_id
+				HAVING count(*) > 1)`, pq.Array(request.AddTags)).Scan(&sameCategory); err != nil {
+			log.Printf("Bulk Song Tags POST - Unable to check tag categories: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if sameCategory {
+			SendError(w, `{"error": "Only one tag from each single select category can be added."}`, http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Bulk Song Tags POST - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		changedSongs := make(map[int64]bool)
+		var result BulkTagResult
+
+		// Remove tags first, so one request can swap a song's tag within a single select category
+		rows, err := tx.Query(`
+			DELETE FROM tagged_songs
+			WHERE tag_id = ANY($1)
+			  AND song_id IN (SELECT song_id FROM songs WHERE collection_id = $2 AND song_id = ANY($3))
+			RETURNING song_id`, pq.Array(request.RemoveTags), collectionID, pq.Array(songIDs))
+		if err == nil {
+			result.TagsRemoved, err = collectChangedSongs(rows, changedSongs)
+		}
+		if err != nil {
+			log.Printf("Bulk Song Tags POST - Unable to remove tags from songs: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Bulk Song Tags POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Add tags, skipping songs that already have the tag or another tag from its single select category
+		rows, err = tx.Query(`
+			INSERT INTO tagged_songs(song_id, tag_id)
+			SELECT s.song_id, t.tag_id
+			FROM songs AS s
+			CROSS JOIN tags AS t
+			WHERE s.collection_id = $1 AND s.song_id = ANY($2) AND t.tag_id = ANY($3)
+			  AND NOT EXISTS (
+			      SELECT 1
+			      FROM tagged_songs AS ts
+			      JOIN tags AS other ON other.tag_id = ts.tag_id
+			      JOIN tag_categories AS c ON c.category_id = other.category_id AND c.single_select
+			      WHERE ts.song_id = s.song_id AND other.category_id = t.category_id AND other.tag_id <> t.tag_id)
+			ON CONFLICT DO NOTHING
+			RETURNING song_id`, collectionID, pq.Array(songIDs), pq.Array(request.AddTags))
+		if err == nil {
+			result.TagsAdded, err = collectChangedSongs(rows, changedSongs)
+		}
+		if err != nil {
+			log.Printf("Bulk Song Tags POST - Unable to add tags to songs: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Bulk Song Tags POST - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Bulk Song Tags POST - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		result.SongsChanged = int64(len(changedSongs))
+		log.Printf("Bulk Song Tags POST - Changed tags on %d songs in collection %d\n", result.SongsChanged, collectionID)
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+}
+
+// collectChangedSongs reads the song IDs returned by a statement into a set, and returns how many rows there were
+func collectChangedSongs(rows *sql.Rows, changedSongs map[int64]bool) (int64, error) {
+	defer rows.Close()
+
+	var count int64
+	for rows.Next() {
+		var songID int64
+		if err := rows.Scan(&songID); err != nil {
+			return count, err
+		}
+		changedSongs[songID] = true
+		count++
+	}
+
+	return count, rows.Err()
+}
+
+// uniqueIDs returns the IDs without duplicates
+func uniqueIDs(ids []int64) []int64 {
+	seen := make(map[int64]bool)
+	unique := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
@@ -1,3 +1,6 @@
+-- Trigram similarity is used for typo-tolerant search
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 CREATE TABLE IF NOT EXISTS users
 (
 	user_id SERIAL PRIMARY KEY,
@@ -7,9 +10,14 @@ CREATE TABLE IF NOT EXISTS users
 	verified BOOLEAN DEFAULT false,
 	restricted BOOLEAN DEFAULT false,
 	created TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-	last_login TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	last_login TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	-- Secret token in the URL of the user's calendar feed
+	calendar_token VARCHAR(32) UNIQUE
 );
 
+-- Columns added since the table was first created, for existing databases
+ALTER TABLE users ADD COLUMN IF NOT EXISTS calendar_token VARCHAR(32) UNIQUE;
+
 CREATE TABLE IF NOT EXISTS verification_emails
 (
 	user_id INT PRIMARY KEY REFERENCES users(user_id),
@@ -21,9 +29,16 @@ CREATE TABLE IF NOT EXISTS collections
 (
 	collection_id SERIAL PRIMARY KEY,
 	name VARCHAR(127) NOT NULL,
-	description VARCHAR(1023)
+	description VARCHAR(1023),
+	-- Public read-only catalog of the collection's songs. The catalog is only public with a share code,
+	-- and only shows song names and the chosen fields.
+	catalog_share_code VARCHAR(16) UNIQUE,
+	catalog_fields VARCHAR(15)[] NOT NULL DEFAULT '{}'
 );
 
+ALTER TABLE collections ADD COLUMN IF NOT EXISTS catalog_share_code VARCHAR(16) UNIQUE;
+ALTER TABLE collections ADD COLUMN IF NOT EXISTS catalog_fields VARCHAR(15)[] NOT NULL DEFAULT '{}';
+
 CREATE TABLE IF NOT EXISTS collection_members
 (
 	user_id INT REFERENCES users(user_id),
@@ -57,29 +72,97 @@ CREATE TABLE IF NOT EXISTS songs
 	song_id SERIAL PRIMARY KEY,
 	name VARCHAR(127) NOT NULL,
 	artist VARCHAR(127),
+	arranger VARCHAR(127),
 	date_added DATE NOT NULL DEFAULT CURRENT_DATE,
 	location VARCHAR(127),
 	last_performed DATE,
 	notes TEXT,
+	key VARCHAR(15),
+	voicing VARCHAR(31),
+	-- Length of the song in seconds
+	duration INT,
 	added_by INT REFERENCES users(user_id),
 	collection_id INT NOT NULL REFERENCES collections(collection_id)
 );
 
+ALTER TABLE songs ADD COLUMN IF NOT EXISTS arranger VARCHAR(127);
+ALTER TABLE songs ADD COLUMN IF NOT EXISTS key VARCHAR(15);
+ALTER TABLE songs ADD COLUMN IF NOT EXISTS voicing VARCHAR(31);
+ALTER TABLE songs ADD COLUMN IF NOT EXISTS duration INT;
+
+CREATE INDEX IF NOT EXISTS songs_name_trgm_idx ON songs USING GIN (name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS songs_artist_trgm_idx ON songs USING GIN (artist gin_trgm_ops);
+
+-- Groups of tags such as Season or Difficulty. A song can only have one tag
+-- from a single select category.
+CREATE TABLE IF NOT EXISTS tag_categories
+(
+	category_id SERIAL PRIMARY KEY,
+	name VARCHAR(127) NOT NULL,
+	single_select BOOL NOT NULL DEFAULT false,
+	collection_id INT NOT NULL REFERENCES collections(collection_id)
+);
+
 CREATE TABLE IF NOT EXISTS tags
 (
 	tag_id SERIAL PRIMARY KEY,
 	name VARCHAR(127) NOT NULL,
 	description TEXT,
+	parent_id INT REFERENCES tags(tag_id),
+	color VARCHAR(7),
+	icon VARCHAR(31),
+	category_id INT REFERENCES tag_categories(category_id),
+	collection_id INT NOT NULL REFERENCES collections(collection_id)
+);
+
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS parent_id INT REFERENCES tags(tag_id);
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS color VARCHAR(7);
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS icon VARCHAR(31);
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS category_id INT REFERENCES tag_categories(category_id);
+
+-- Every tag paired with itself and each of its ancestors, so that a song
+-- tagged with a child tag also matches the parent tags.
+-- UNION rather than UNION ALL stops the recursion even if the tags somehow form a cycle.
+CREATE OR REPLACE RECURSIVE VIEW tag_ancestors(tag_id, ancestor_id) AS
+	SELECT tag_id, tag_id FROM tags
+	UNION
+	SELECT ta.tag_id, t.parent_id
+	FROM tag_ancestors AS ta
+	JOIN tags AS t ON t.tag_id = ta.ancestor_id
+	WHERE t.parent_id IS NOT NULL;
+
+-- Rules that tag every song whose field matches a condition, such as artist contains Rutter
+CREATE TABLE IF NOT EXISTS tag_rules
+(
+	rule_id SERIAL PRIMARY KEY,
+	field VARCHAR(31) NOT NULL,
+	operator VARCHAR(15) NOT NULL,
+	value TEXT NOT NULL DEFAULT '',
+	tag_id INT NOT NULL REFERENCES tags(tag_id),
 	collection_id INT NOT NULL REFERENCES collections(collection_id)
 );
 
+-- rule_id is set when a tagging rule assigned the tag, and NULL when it was added by hand
 CREATE TABLE IF NOT EXISTS tagged_songs
 (
 	song_id INT REFERENCES songs(song_id),
 	tag_id INT REFERENCES tags(tag_id),
+	rule_id INT REFERENCES tag_rules(rule_id),
 	PRIMARY KEY (song_id, tag_id)
 );
 
+ALTER TABLE tagged_songs ADD COLUMN IF NOT EXISTS rule_id INT REFERENCES tag_rules(rule_id);
+
+CREATE TABLE IF NOT EXISTS saved_searches
+(
+	saved_search_id SERIAL PRIMARY KEY,
+	name VARCHAR(127) NOT NULL,
+	search JSONB NOT NULL,
+	shared BOOL NOT NULL DEFAULT false,
+	user_id INT NOT NULL REFERENCES users(user_id),
+	collection_id INT NOT NULL REFERENCES collections(collection_id)
+);
+
 CREATE TABLE IF NOT EXISTS setlists
 (
 	setlist_id SERIAL PRIMARY KEY,
@@ -88,49 +171,229 @@ CREATE TABLE IF NOT EXISTS setlists
 	notes TEXT,
 	shared BOOL NOT NULL DEFAULT false,
 	share_code VARCHAR(16) UNIQUE,
+	-- Optional protection for the share link. The password is hashed, and visitors who unlocked the link
+	-- before the password last changed have to enter it again.
+	share_expires TIMESTAMPTZ,
+	share_password TEXT,
+	share_password_changed TIMESTAMPTZ,
+	-- How often the public setlist has been viewed, and when it was last viewed
+	views INT NOT NULL DEFAULT 0,
+	last_accessed TIMESTAMPTZ,
+	-- Include entry notes, keys, instructions and performers in the public view
+	public_details BOOL NOT NULL DEFAULT false,
+	-- Timing plan: seconds between pieces, and how long the setlist should run in seconds
+	gap INT NOT NULL DEFAULT 0,
+	target_length INT,
 	user_id INT NOT NULL REFERENCES users(user_id),
 	collection_id INT NOT NULL REFERENCES collections(collection_id)
 );
 
+ALTER TABLE setlists ADD COLUMN IF NOT EXISTS share_expires TIMESTAMPTZ;
+ALTER TABLE setlists ADD COLUMN IF NOT EXISTS share_password TEXT;
+ALTER TABLE setlists ADD COLUMN IF NOT EXISTS share_password_changed TIMESTAMPTZ;
+ALTER TABLE setlists ADD COLUMN IF NOT EXISTS views INT NOT NULL DEFAULT 0;
+ALTER TABLE setlists ADD COLUMN IF NOT EXISTS last_accessed TIMESTAMPTZ;
+ALTER TABLE setlists ADD COLUMN IF NOT EXISTS public_details BOOL NOT NULL DEFAULT false;
+ALTER TABLE setlists ADD COLUMN IF NOT EXISTS gap INT NOT NULL DEFAULT 0;
+ALTER TABLE setlists ADD COLUMN IF NOT EXISTS target_length INT;
+
+-- Share codes a setlist has had, and when they were revoked by rotating the link or making the setlist private
+CREATE TABLE IF NOT EXISTS setlist_share_links
+(
+	share_link_id SERIAL PRIMARY KEY,
+	share_code VARCHAR(16) NOT NULL,
+	created TIMESTAMPTZ NOT NULL DEFAULT now(),
+	revoked TIMESTAMPTZ,
+	setlist_id INT NOT NULL REFERENCES setlists(setlist_id)
+);
+
+-- Parts of a setlist such as Prelude, Set 1, Intermission or Encore
+CREATE TABLE IF NOT EXISTS setlist_sections
+(
+	section_id SERIAL PRIMARY KEY,
+	name VARCHAR(127) NOT NULL,
+	"order" INT NOT NULL DEFAULT 0,
+	setlist_id INT NOT NULL REFERENCES setlists(setlist_id)
+);
+
+-- Entries in a setlist. An entry is either a song, which may appear more than once,
+-- or free text such as Announcements with an optional duration in seconds.
+-- Entries are ordered within their section. section_id is NULL for entries outside of any section.
+-- Each entry can say how the song is performed this time, e.g. in a different key or with only some verses.
 CREATE TABLE IF NOT EXISTS setlist_songs
 (
+	item_id SERIAL PRIMARY KEY,
 	setlist_id INT NOT NULL REFERENCES setlists(setlist_id),
-	song_id INT NOT NULL REFERENCES songs(song_id),
+	song_id INT REFERENCES songs(song_id),
+	title VARCHAR(255),
+	duration INT,
 	"order" INT NOT NULL DEFAULT 0,
-	PRIMARY KEY (setlist_id, song_id)
+	section_id INT REFERENCES setlist_sections(section_id),
+	notes TEXT,
+	performance_key VARCHAR(15),
+	instruction VARCHAR(255),
+	CHECK (song_id IS NOT NULL OR title IS NOT NULL)
 );
 
-CREATE OR REPLACE FUNCTION search_collection(collection_id INTEGER,	query TEXT)
-    RETURNS TABLE(song_id INTEGER, song_name TEXT) 
-    LANGUAGE 'plpgsql'
-AS $BODY$
-DECLARE
--- variable declaration
+ALTER TABLE setlist_songs ADD COLUMN IF NOT EXISTS title VARCHAR(255);
+ALTER TABLE setlist_songs ADD COLUMN IF NOT EXISTS duration INT;
+ALTER TABLE setlist_songs ADD COLUMN IF NOT EXISTS section_id INT REFERENCES setlist_sections(section_id);
+ALTER TABLE setlist_songs ADD COLUMN IF NOT EXISTS notes TEXT;
+ALTER TABLE setlist_songs ADD COLUMN IF NOT EXISTS performance_key VARCHAR(15);
+ALTER TABLE setlist_songs ADD COLUMN IF NOT EXISTS instruction VARCHAR(255);
+
+-- Entries used to be keyed by setlist and song, so a song could only appear once and every entry was a song
+DO $$
 BEGIN
-RETURN QUERY
-	SELECT s_search.song_id, s_search.song_name
-	FROM (SELECT s.song_id as song_id,
-			     s.name as song_name,
-			     setweight(to_tsvector(s.name), 'A') ||
-			     setweight(to_tsvector(s.artist), 'B') ||
-			     setweight(to_tsvector(s.location), 'B') ||
-			     setweight(to_tsvector(s.notes), 'B') ||
-			     setweight(to_tsvector(coalesce(string_agg(t.name, ' '), '')), 'C') AS document
-		FROM songs AS s
-		LEFT JOIN tagged_songs AS ts ON s.song_id = ts.song_id
-		LEFT JOIN tags AS t ON t.tag_id = ts.tag_id
-		WHERE s.collection_id = search_collection.collection_id
-		GROUP BY s.song_id) s_search
-	WHERE s_search.document @@ to_tsquery(query)
-    ORDER BY ts_rank(s_search.document, to_tsquery(query)) DESC;
-END;
-$BODY$;
+	IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'setlist_songs' AND column_name = 'item_id') THEN
+		ALTER TABLE setlist_songs DROP CONSTRAINT setlist_songs_pkey;
+		ALTER TABLE setlist_songs ADD COLUMN item_id SERIAL PRIMARY KEY;
+		ALTER TABLE setlist_songs ALTER COLUMN song_id DROP NOT NULL;
+		ALTER TABLE setlist_songs ADD CONSTRAINT setlist_songs_check CHECK (song_id IS NOT NULL OR title IS NOT NULL);
+	END IF;
+END $$;
+
+-- Collection members who can view or edit a setlist they don't own
+CREATE TABLE IF NOT EXISTS setlist_collaborators
+(
+	setlist_id INT REFERENCES setlists(setlist_id),
+	user_id INT REFERENCES users(user_id),
+	can_edit BOOL NOT NULL DEFAULT false,
+	PRIMARY KEY (setlist_id, user_id)
+);
+
+-- Reusable shapes for setlists, such as a weekly service
+CREATE TABLE IF NOT EXISTS setlist_templates
+(
+	template_id SERIAL PRIMARY KEY,
+	name VARCHAR(127) NOT NULL,
+	notes TEXT,
+	gap INT NOT NULL DEFAULT 0,
+	target_length INT,
+	collection_id INT NOT NULL REFERENCES collections(collection_id)
+);
+
+-- Placeholders in a setlist template, such as Opening hymn or Anthem, that are filled in when a setlist is created.
+-- A slot can suggest a song. Slots with the same section name become one section.
+CREATE TABLE IF NOT EXISTS setlist_template_slots
+(
+	slot_id SERIAL PRIMARY KEY,
+	template_id INT NOT NULL REFERENCES setlist_templates(template_id),
+	label VARCHAR(255) NOT NULL,
+	section VARCHAR(127),
+	duration INT,
+	song_id INT REFERENCES songs(song_id),
+	"order" INT NOT NULL DEFAULT 0
+);
+
+-- Places a collection performs
+CREATE TABLE IF NOT EXISTS venues
+(
+	venue_id SERIAL PRIMARY KEY,
+	name VARCHAR(127) NOT NULL,
+	address VARCHAR(255),
+	notes TEXT,
+	collection_id INT NOT NULL REFERENCES collections(collection_id)
+);
+
+-- Performances and other dated events. call_time is when performers need to arrive.
+CREATE TABLE IF NOT EXISTS events
+(
+	event_id SERIAL PRIMARY KEY,
+	name VARCHAR(127) NOT NULL,
+	start_time TIMESTAMPTZ NOT NULL,
+	end_time TIMESTAMPTZ,
+	call_time TIMESTAMPTZ,
+	dress_code VARCHAR(255),
+	notes TEXT,
+	venue_id INT REFERENCES venues(venue_id),
+	collection_id INT NOT NULL REFERENCES collections(collection_id)
+);
+
+-- Setlists performed at an event
+CREATE TABLE IF NOT EXISTS event_setlists
+(
+	event_id INT NOT NULL REFERENCES events(event_id),
+	setlist_id INT NOT NULL REFERENCES setlists(setlist_id),
+	PRIMARY KEY (event_id, setlist_id)
+);
+
+-- Each time a song was performed, optionally at an event
+CREATE TABLE IF NOT EXISTS song_performances
+(
+	performance_id SERIAL PRIMARY KEY,
+	song_id INT NOT NULL REFERENCES songs(song_id),
+	date DATE NOT NULL,
+	event_id INT REFERENCES events(event_id),
+	notes TEXT
+);
+
+-- Rehearsals toward an event, a setlist, or both
+CREATE TABLE IF NOT EXISTS rehearsals
+(
+	rehearsal_id SERIAL PRIMARY KEY,
+	start_time TIMESTAMPTZ NOT NULL,
+	notes TEXT,
+	event_id INT REFERENCES events(event_id),
+	setlist_id INT REFERENCES setlists(setlist_id),
+	collection_id INT NOT NULL REFERENCES collections(collection_id)
+);
+
+-- Songs planned for a rehearsal, with the minutes allotted. readiness is rated from 1 to 5 after the rehearsal.
+CREATE TABLE IF NOT EXISTS rehearsal_songs
+(
+	rehearsal_id INT NOT NULL REFERENCES rehearsals(rehearsal_id),
+	song_id INT NOT NULL REFERENCES songs(song_id),
+	minutes INT,
+	readiness SMALLINT CHECK (readiness BETWEEN 1 AND 5),
+	"order" INT NOT NULL DEFAULT 0,
+	PRIMARY KEY (rehearsal_id, song_id)
+);
+
+-- Collection members assigned to perform a setlist entry, such as a soloist
+CREATE TABLE IF NOT EXISTS setlist_performers
+(
+	item_id INT REFERENCES setlist_songs(item_id),
+	user_id INT REFERENCES users(user_id),
+	PRIMARY KEY (item_id, user_id)
+);
+
+-- Full text search document for each song, used by the search query language
+CREATE OR REPLACE VIEW song_documents AS
+	SELECT s.song_id,
+		   s.collection_id,
+		   setweight(to_tsvector(coalesce(s.name, '')), 'A') ||
+		   setweight(to_tsvector(coalesce(s.artist, '')), 'B') ||
+		   setweight(to_tsvector(coalesce(s.location, '')), 'B') ||
+		   setweight(to_tsvector(coalesce(s.notes, '')), 'B') ||
+		   setweight(to_tsvector(coalesce((
+		       SELECT string_agg(t.name, ' ')
+		       FROM tagged_songs AS ts
+		       JOIN tag_ancestors AS ta ON ta.tag_id = ts.tag_id
+		       JOIN tags AS t ON t.tag_id = ta.ancestor_id
+		       WHERE ts.song_id = s.song_id), '')), 'C') AS document,
+		   ARRAY(SELECT t.name
+		         FROM tagged_songs AS ts
+		         JOIN tags AS t ON t.tag_id = ts.tag_id
+		         WHERE ts.song_id = s.song_id
+		         ORDER BY t.name) AS tags
+	FROM songs AS s;
+
+-- Basic search is done by the search query language now
+DROP FUNCTION IF EXISTS search_collection(INTEGER, TEXT);
+
+-- The tag modes and date added filters changed the signature of advanced_search_collection
+DROP FUNCTION IF EXISTS advanced_search_collection(INTEGER, INTEGER[], DATE, DATE, TEXT, TEXT);
 
 CREATE OR REPLACE FUNCTION advanced_search_collection(
 	collection_id INTEGER,
-	tags INTEGER[],
+	any_tags INTEGER[],
+	all_tags INTEGER[],
+	exclude_tags INTEGER[],
 	before DATE,
 	after DATE,
+	added_before DATE,
+	added_after DATE,
 	include_keywords TEXT,
 	exclude_keywords TEXT)
     RETURNS TABLE(song_id INTEGER, song_name TEXT) 
@@ -141,23 +404,33 @@ DECLARE
 -- variable declaration
 BEGIN	
 RETURN QUERY
-	SELECT s_search.song_id, s_search.song_name
-	FROM (SELECT s.song_id as song_id,
-			     s.name as song_name,
-			     setweight(to_tsvector(s.name), 'A') ||
-			     setweight(to_tsvector(s.artist), 'B') ||
-			     setweight(to_tsvector(s.location), 'B') ||
-			     setweight(to_tsvector(s.notes), 'B') ||
-			     setweight(to_tsvector(coalesce(string_agg(t.name, ' '), '')), 'C') AS document
-		  FROM songs AS s
-		  LEFT JOIN tagged_songs AS ts ON s.song_id = ts.song_id
-		  LEFT JOIN tags AS t ON t.tag_id = ts.tag_id
-		  WHERE s.collection_id = advanced_search_collection.collection_id
-		    AND (ts.tag_id = ANY(tags) OR tags IS NULL OR tags = '{}')
-		    AND (s.last_performed <= before OR s.last_performed IS NULL OR before IS NULL)
-		    AND (s.last_performed >= after OR s.last_performed IS NULL OR after IS NULL)
-		  GROUP BY s.song_id) s_search
-	WHERE s_search.document @@ (to_tsquery(include_keywords) && (!! to_tsquery(exclude_keywords)))
-    ORDER BY ts_rank(s_search.document, to_tsquery(include_keywords) && (!! to_tsquery(exclude_keywords))) DESC;
+	SELECT s.song_id, s.name::TEXT
+	FROM songs AS s
+	JOIN song_documents AS d ON d.song_id = s.song_id
+	WHERE s.collection_id = advanced_search_collection.collection_id
+	  -- Any of these tags
+	  AND (any_tags IS NULL OR any_tags = '{}' OR EXISTS (
+	      SELECT 1 FROM tagged_songs AS ts JOIN tag_ancestors AS ta ON ta.tag_id = ts.tag_id
+	      WHERE ts.song_id = s.song_id AND ta.ancestor_id = ANY(any_tags)))
+	  -- All of these tags
+	  AND (all_tags IS NULL OR NOT EXISTS (
+	      SELECT 1 FROM unnest(all_tags) AS required(tag_id)
+	      WHERE NOT EXISTS (
+	          SELECT 1 FROM tagged_songs AS ts JOIN tag_ancestors AS ta ON ta.tag_id = ts.tag_id
+	          WHERE ts.song_id = s.song_id AND ta.ancestor_id = required.tag_id)))
+	  -- None of these tags
+	  AND (exclude_tags IS NULL OR NOT EXISTS (
+	      SELECT 1 FROM tagged_songs AS ts JOIN tag_ancestors AS ta ON ta.tag_id = ts.tag_id
+	      WHERE ts.song_id = s.song_id AND ta.ancestor_id = ANY(exclude_tags)))
+	  AND (s.last_performed <= before OR s.last_performed IS NULL OR before IS NULL)
+	  AND (s.last_performed >= after OR s.last_performed IS NULL OR after IS NULL)
+	  AND (s.date_added <= added_before OR added_before IS NULL)
+	  AND (s.date_added >= added_after OR added_after IS NULL)
+	  -- Keywords are optional, so that songs can be browsed by tag alone
+	  AND (coalesce(include_keywords, '') = '' OR d.document @@ to_tsquery(include_keywords))
+	  AND (coalesce(exclude_keywords, '') = '' OR NOT d.document @@ to_tsquery(exclude_keywords))
+	ORDER BY CASE WHEN coalesce(include_keywords, '') = '' THEN 0
+	              ELSE ts_rank(d.document, to_tsquery(include_keywords)) END DESC,
+	         s.name;
 END;
 $BODY$;
\ No newline at end of file
@@ -51,6 +51,34 @@ $(function() {
 	refresh_account();
 });
 
+// Calendar feed
+$("#show_calendar_feed").click(function(event) {
+	event.preventDefault();
+	$.get("/user/calendar")
+	.done(function(data) {
+		$("#calendar_feed_input").val(data.url);
+		$("#show_calendar_feed").addClass("hidden");
+		$("#calendar_feed").removeClass("hidden");
+	})
+	.fail(function(data) {
+		alert_ajax_failure("Unable to get calendar feed link.", data);
+	});
+});
+$("#new_calendar_feed").click(function(event) {
+	event.preventDefault();
+	if (!confirm("Calendars subscribed to the current link will stop updating. Do you want to replace it?")) {
+		return;
+	}
+	$.post("/user/calendar")
+	.done(function(data) {
+		$("#calendar_feed_input").val(data.url);
+		add_alert("Calendar feed replaced", "Subscribe to the new link in your calendar app.", "success");
+	})
+	.fail(function(data) {
+		alert_ajax_failure("Unable to replace calendar feed link.", data);
+	});
+});
+
 // Verification
 $("#send_verification_email").click(function() {
 	send_verification_email = true;
@@ -93,10 +93,10 @@ $("#search_button").click(function() {
 
         $("#search_results").empty();
 
-        if (data.length == 0) {
+        if (data.results.length == 0) {
             $("#search_results").append($("<div>").text("No results."));
         } else {
-            data.forEach(song => {
+            data.results.forEach(song => {
                 console.log("Hello from " + song.song_name);
                 let element = $("<a>")
                 .attr("href", `song.html?collection_id=${collection_id}&song_id=${song.song_id}`)
@@ -32,7 +32,7 @@ $(function() {
 
 		$("#search_results").empty();
 
-        data.forEach(result => {
+        data.results.forEach(result => {
             let element = $("<a>")
             .attr("href", `song.html?collection_id=${collection_id}&song_id=${result.song_id}`)
             .addClass("list-group-item list-group-item-action")
@@ -29,6 +29,7 @@ let setlist = {
     notes: undefined,
     shared: undefined,
     share_code: undefined,
+    access: undefined,
 };
 
 // Show options in navbar
@@ -41,6 +42,10 @@ $("#search_form").removeClass("hidden");
 // Replace link for collection
 $("#collection_link").attr("href", "/collection.html?collection_id=" + setlist.collection_id);
 $("#setlists_link").attr("href", "/setlists.html?collection_id=" + setlist.collection_id);
+$("#print_program_link").attr("href", `/collections/${setlist.collection_id}/setlists/${setlist.setlist_id}/program.pdf?template=audience`);
+$("#print_running_order_link").attr("href", `/collections/${setlist.collection_id}/setlists/${setlist.setlist_id}/program.pdf?template=conductor`);
+$("#print_binder_link").attr("href", `/collections/${setlist.collection_id}/setlists/${setlist.setlist_id}/binder.pdf`);
+$("#calendar_link").attr("href", `/collections/${setlist.collection_id}/setlists/${setlist.setlist_id}/calendar.ics`);
 
 // Enable tooltips
 // $(".visibility_icon").tooltip();
@@ -59,6 +64,7 @@ function refresh_setlist() {
         setlist.notes = data.notes;
         setlist.shared = data.shared;
         setlist.share_code = data.share_code;
+        setlist.access = data.access;
         
         console.log("Setlist:");
         console.log(setlist);
@@ -96,7 +102,8 @@ function refresh_setlist_songs() {
 		console.log("Loading songs result:");
         console.log(data);
 
-        songs = data;
+        // Songs are grouped by section, and already in order
+        songs = data.flatMap(section => section.items);
         
         console.log("Songs:");
         console.log(songs);
@@ -112,13 +119,17 @@ function refresh_setlist_songs() {
             $("#songs_container_delete").html("&nbsp;");
             $("#songs_container_reorder").html("&nbsp;");
         } else {
-            songs.sort((a, b) => a.order - b.order).forEach(song => {
+            songs.forEach(song => {
     
-                let element = $("<a>")
-                .attr("href", `song.html?collection_id=${setlist.collection_id}&song_id=${song.song_id}`)
-                .addClass("list-group-item list-group-item-action")
-                .attr("data-id", song.song_id)
+                // Free text items don't link to a song
+                let element = $(song.song_id ? "<a>" : "<div>")
+                .addClass("list-group-item")
+                .attr("data-id", song.item_id)
                 .text(song.name);
+                if (song.song_id) {
+                    element.attr("href", `song.html?collection_id=${setlist.collection_id}&song_id=${song.song_id}`)
+                        .addClass("list-group-item-action");
+                }
     
                 $("#songs_container").append(element);
 
@@ -128,6 +139,7 @@ function refresh_setlist_songs() {
                     .addClass("list-group-item")
                     .text(song.name)
                     .data("song_id", song.song_id)
+                    .data("item_id", song.item_id)
                     .click(remove_from_setlist)
                     .hover(function() { if(mode == modes.REMOVE) { $(this).toggleClass("list-group-item-danger"); }});
                 $("#songs_container_delete").append(element);
@@ -136,8 +148,9 @@ function refresh_setlist_songs() {
                 element = $("<div>")
                     .addClass("list-group-item")
                     .text(song.name)
-                    .data("song_id", song.song_id)
-                    .attr("data-id", song.song_id);
+                    .data("item_id", song.item_id)
+                    .data("section_id", song.section_id)
+                    .attr("data-id", song.item_id);
                 $("#songs_container_reorder").append(element);
             });
         }
@@ -184,9 +197,10 @@ function refresh_add_song_list() {
 function remove_from_setlist() {
     let self = $(this);
     let song_id = self.data("song_id");
+    let item_id = self.data("item_id");
 
-    if (!song_id) {
-        console.error("Unable to get song_id to delete!");
+    if (!item_id) {
+        console.error("Unable to get item_id to delete!");
         add_alert("Unable to remove song from setlist", "There was a problem deleting this song. Please refresh the page and try again.", "danger");
         return;
     }
@@ -195,13 +209,13 @@ function remove_from_setlist() {
     self.attr("title", "Deleting song... Please wait. If this song doesn't disappear after 30 seconds, please refresh the page.");
 
     $.ajax({
-        url:`/collections/${setlist.collection_id}/setlists/${setlist.setlist_id}/songs/${song_id}`, 
+        url:`/collections/${setlist.collection_id}/setlists/${setlist.setlist_id}/items/${item_id}`, 
         method: "DELETE",
     })
     .done(function(data) {
-        console.log(`Successfully removed song ${song_id}`);
-        $(`#songs_container_reorder div[data-id="${song_id}"]`).remove();
-        $(`#songs_container a[data-id="${song_id}"]`).hide(500, function() { $(this).remove(); });
+        console.log(`Successfully removed item ${item_id}`);
+        $(`#songs_container_reorder div[data-id="${item_id}"]`).remove();
+        $(`#songs_container [data-id="${item_id}"]`).hide(500, function() { $(this).remove(); });
         self.hide(500, function() { self.remove(); });
         // refresh_add_song_list();
 
@@ -409,7 +423,8 @@ $("#setlist_order_wait_modal").on("shown.bs.modal", function() {
     let payload = [];
     $("#songs_container_reorder div").each(function(index, element) { 
         payload.push({
-            song_id: $(element).data("song_id"),
+            item_id: $(element).data("item_id"),
+            section_id: $(element).data("section_id"),
             order: index+1, // Avoid zero, and that causes the Go backend to assume its null
         });
     });
@@ -469,8 +484,91 @@ function update_share_link(visibility) {
     } else {
         $("#share_code_form_group").addClass("hidden");
     }
+
+    // Only public links have an expiration, password and view count
+    if (visibility === "public" && setlist.access === "owner") {
+        $("#rotate_link_button").removeClass("hidden");
+        $("#share_settings_form_group").removeClass("hidden");
+        refresh_share_settings();
+    } else {
+        $("#rotate_link_button").addClass("hidden");
+        $("#share_settings_form_group").addClass("hidden");
+        $("#share_link_views").text("");
+    }
 }
 
+function refresh_share_settings() {
+    $.get(`/collections/${setlist.collection_id}/setlists/${setlist.setlist_id}/share`)
+    .done(function(data) {
+        console.log("Loading share settings result:");
+        console.log(data);
+
+        $("#share_expires_input").val(data.expires ? data.expires.substring(0, 10) : "");
+        $("#share_password_input").val("").attr("placeholder", data.has_password ? "Unchanged" : "No password");
+        $("#remove_share_password_checkbox").prop("checked", false).prop("disabled", !data.has_password);
+
+        let views = `Viewed ${data.views} ${data.views === 1 ? "time" : "times"}`;
+        if (data.last_accessed) {
+            views += `, last on ${new Date(data.last_accessed).toLocaleString()}`;
+        }
+        let revoked = (data.history || []).filter(link => link.revoked).length;
+        if (revoked > 0) {
+            views += `. ${revoked} previous ${revoked === 1 ? "link has" : "links have"} been revoked.`;
+        }
+        $("#share_link_views").text(views);
+    })
+    .fail(function(data) {
+        alert_ajax_failure("Unable to get share link settings.", data);
+    });
+}
+
+$("#save_share_settings_button").click(function() {
+    let payload = {};
+    let expires = $("#share_expires_input").val();
+    if (expires) {
+        // The link works until the end of the chosen day
+        payload.expires = new Date(`${expires}T23:59:59`).toISOString();
+    } else {
+        payload.never_expires = true;
+    }
+    if ($("#remove_share_password_checkbox").prop("checked")) {
+        payload.password = "";
+    } else if ($("#share_password_input").val()) {
+        payload.password = $("#share_password_input").val();
+    }
+
+    $.ajax({
+        method: "PUT",
+        url: `/collections/${setlist.collection_id}/setlists/${setlist.setlist_id}/share`,
+        data: JSON.stringify(payload),
+        headers: {
+            "Content-Type": "application/json"
+        }
+    })
+    .done(function() {
+        refresh_share_settings();
+        add_alert("Changes saved.", "The share link settings have been updated.", "success");
+    })
+    .fail(function(data) {
+        alert_ajax_failure("Unable to update share link settings.", data);
+    });
+});
+
+$("#rotate_link_button").click(function() {
+    if (!confirm("The current link will stop working. Do you want to create a new link?")) {
+        return;
+    }
+
+    $.post(`/collections/${setlist.collection_id}/setlists/${setlist.setlist_id}/share/rotate`)
+    .done(function(data) {
+        setlist.share_code = data;
+        update_share_link("public");
+    })
+    .fail(function(data) {
+        alert_ajax_failure("Unable to create a new share link.", data);
+    });
+});
+
 $("input[name=visibility_radio]").change(function() {
     $("#save_setlist_visibility_button").prop("disabled", false);
 });
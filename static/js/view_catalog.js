@@ -0,0 +1,96 @@
+"use strict";
+
+import { alert_ajax_failure } from "./utilities.js";
+
+let url = new URL(window.location.href);
+
+let catalog = {
+    // Parse share code from URL parameter
+    share_code: url.searchParams.get("code"),
+
+    // These attributes get set after an AJAX call to server
+    name: undefined,
+    description: undefined,
+    fields: [],
+};
+
+let search = {
+    query: "",
+    page: 1,
+};
+
+function refresh_catalog() {
+    $.get(`/catalogs/${catalog.share_code}`)
+    .done(function(data) {
+        console.log("Loading catalog result:");
+        console.log(data);
+        catalog.name = data.name;
+        catalog.description = data.description;
+        catalog.fields = data.fields;
+
+        // Update page UI
+        $("#page_header").text(catalog.name);
+        document.title = `${catalog.name} - Catalog - Sheet Music Organizer`;
+        $("#catalog_description").text(catalog.description || "");
+    })
+    .fail(function(data) {
+        alert_ajax_failure("Unable to get catalog information.", data);
+    });
+}
+
+function refresh_catalog_songs() {
+    $.get(`/catalogs/${catalog.share_code}/songs`, {q: search.query, page: search.page})
+    .done(function(data) {
+        console.log("Loading songs result:");
+        console.log(data);
+
+        $("#songs_container").empty();
+        $("#catalog_count").text(`${data.total} ${data.total === 1 ? "song" : "songs"}`);
+
+        data.songs.forEach(song => {
+            let element = $("<div>")
+            .addClass("list-group-item")
+            .text(song.name);
+
+            // Only the fields the collection chose to share are sent
+            let credit = [song.composer, song.arranger ? `arr. ${song.arranger}` : ""].filter(detail => detail).join(", ");
+            let details = [credit, song.key, song.voicing, (song.tags || []).join(", ")].filter(detail => detail);
+            if (details.length > 0) {
+                element.append($("<small>").addClass("d-block text-muted").text(details.join(" - ")));
+            }
+
+            $("#songs_container").append(element);
+        });
+
+        // Page links
+        $("#catalog_pages").empty();
+        if (data.pages > 1) {
+            for (let page = 1; page <= data.pages; page++) {
+                let item = $("<li>").addClass("page-item").toggleClass("active", page === data.page);
+                item.append($("<a>").addClass("page-link").attr("href", "#").text(page).click(function(event) {
+                    event.preventDefault();
+                    search.page = page;
+                    refresh_catalog_songs();
+                }));
+                $("#catalog_pages").append(item);
+            }
+        }
+    })
+    .fail(function(data) {
+        alert_ajax_failure("Unable to get songs.", data);
+    });
+}
+
+$("#catalog_search_form").submit(function(event) {
+    event.preventDefault();
+    search.query = $("#catalog_search_input").val();
+    search.page = 1;
+    refresh_catalog_songs();
+});
+
+// Startup function
+$(function() {
+    // Load catalog information
+    refresh_catalog();
+    refresh_catalog_songs();
+});
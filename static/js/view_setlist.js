@@ -40,10 +40,42 @@ function refresh_setlist() {
         setlist.notes ? $("#setlist_notes").text(setlist.notes) : $("#setlist_notes").html("&nbsp;");
     })
     .fail(function(data) {
+        if (data.responseJSON && data.responseJSON.password_required) {
+            unlock_setlist();
+            return;
+        }
         alert_ajax_failure("Unable to get setlist information.", data);
     });
 }
 
+function unlock_setlist() {
+    let password = prompt("This setlist is protected by a password. Please enter the password to view it.");
+    if (password === null) {
+        $("#page_header").text("Password required");
+        return;
+    }
+
+    $.ajax({
+        method: "POST",
+        url: `/setlists/${setlist.share_code}/unlock`,
+        data: JSON.stringify({password: password}),
+        headers: {
+            "Content-Type": "application/json"
+        }
+    })
+    .done(function() {
+        refresh_setlist();
+        refresh_setlist_songs();
+    })
+    .fail(function(data) {
+        if (data.status === 401) {
+            unlock_setlist();
+            return;
+        }
+        alert_ajax_failure("Unable to unlock setlist.", data);
+    });
+}
+
 function refresh_setlist_songs() {
     // Get songs in this setlist
     $.get(`/setlists/${setlist.share_code}/songs`)
@@ -51,7 +83,8 @@ function refresh_setlist_songs() {
 		console.log("Loading songs result:");
         console.log(data);
 
-        songs = data;
+        // Songs are grouped by section, and already in order
+        songs = data.flatMap(section => section.items);
         
         console.log("Songs:");
         console.log(songs);
@@ -62,17 +95,34 @@ function refresh_setlist_songs() {
         if (songs.length === 0) {
             $("#songs_container").html("&nbsp;");
         } else {
-            songs.sort((a, b) => a.order - b.order).forEach(song => {
-    
-                let element = $("<div>")
-                .addClass("list-group-item")
-                .text(song.name);
-    
-                $("#songs_container").append(element);
+            data.forEach(section => {
+                if (section.name) {
+                    $("#songs_container").append($("<div>")
+                        .addClass("list-group-item list-group-item-secondary font-weight-bold")
+                        .text(section.name));
+                }
+
+                section.items.forEach(song => {
+                    let element = $("<div>")
+                    .addClass("list-group-item")
+                    .text(song.name);
+
+                    // Performance details are only sent if the setlist owner chose to show them
+                    let details = [song.key, song.instruction, (song.performers || []).join(", "), song.notes].filter(detail => detail);
+                    if (details.length > 0) {
+                        element.append($("<small>").addClass("d-block text-muted").text(details.join(" - ")));
+                    }
+        
+                    $("#songs_container").append(element);
+                });
             });
         }
     })
     .fail(function(data) {
+        // The setlist information asks for the password
+        if (data.responseJSON && data.responseJSON.password_required) {
+            return;
+        }
         alert_ajax_failure("Unable to get songs.", data);
     });
 }
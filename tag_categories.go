@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// TagCategory is a struct that models a group of tags such as Season or Difficulty, both in the request body, and in the DB.
+// A song can only have one tag from a single select category.
+type TagCategory struct {
+	CategoryID   int64  `json:"category_id" db:"category_id"`
+	Name         string `json:"name" db:"name"`
+	SingleSelect bool   `json:"single_select" db:"single_select"`
+	CollectionID int64  `json:"collection_id" db:"collection_id"`
+}
+
+// Tag colors are stored as CSS hex colors
+var tagColorPattern = regexp.MustCompile("^#[0-9a-fA-F]{6}$")
+
+// TagCategoriesHandler handles GETting all tag categories or POSTing a new tag category.
+func TagCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Tag Categories handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		rows, err := db.Query("SELECT category_id, name, single_select FROM tag_categories WHERE collection_id = $1 ORDER BY name", collectionID)
+		if err != nil {
+			log.Printf("Tag Categories GET - Unable to retrieve tag categories from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// Retrieve rows from database
+		categories := make([]TagCategory, 0)
+		for rows.Next() {
+			category := TagCategory{CollectionID: collectionID}
+			if err := rows.Scan(&category.CategoryID, &category.Name, &category.SingleSelect); err != nil {
+				log.Printf("Tag Categories GET - Unable to retrieve row from database result: %v\n", err)
+				continue
+			}
+			categories = append(categories, category)
+		}
+
+		// Check for errors from iterating over rows.
+		if err := rows.Err(); err != nil {
+			log.Printf("Tag Categories GET - Unable to get tag categories from database result: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(categories)
+		return
+
+	} else if r.Method == "POST" {
+		var category TagCategory
+		if err := json.NewDecoder(r.Body).Decode(&category); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Tag Categories POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if category.Name == "" {
+			SendError(w, `{"error": "No category name supplied."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Create category in database
+		category.CollectionID = collectionID
+		if err = db.QueryRow("INSERT INTO tag_categories(name, single_select, collection_id) VALUES ($1, $2, $3) RETURNING category_id",
+			category.Name, category.SingleSelect, collectionID).Scan(&category.CategoryID); err != nil {
+			log.Printf("Tag Categories POST - Unable to insert tag category in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(category)
+		return
+	}
+}
+
+// TagCategoryHandler handles GETting, updating, or deleting a single tag category.
+func TagCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	var category TagCategory
+	var err error
+
+	// Get URL parameters
+	category.CollectionID, err = strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Tag Category handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	category.CategoryID, err = strconv.ParseInt(mux.Vars(r)["category_id"], 10, 64)
+	if err != nil {
+		log.Printf("Tag Category handler - Unable to parse category id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		if err = db.QueryRow("SELECT name, single_select FROM tag_categories WHERE category_id = $1 AND collection_id = $2", category.CategoryID, category.CollectionID).Scan(&category.Name, &category.SingleSelect); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Tag category not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Tag Category GET - Unable to get tag category from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(category)
+		return
+
+	} else if r.Method == "PUT" {
+		// Save the URL IDs so the user can't update another record
+		var collectionID = category.CollectionID
+		var categoryID = category.CategoryID
+
+		if err := json.NewDecoder(r.Body).Decode(&category); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Tag Category PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if category.Name == "" {
+			SendError(w, `{"error": "No category name supplied."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Songs that already have several tags from this category would break the single select rule
+		if category.SingleSelect {
+			var songs int64
+			if err = db.QueryRow(`
+				SELECT count(*) FROM (
+					SELECT ts.song_id
+					FROM tagged_songs AS ts
+					JOIN tags AS t ON t.tag_id = ts.tag_id
+					WHERE t.category_id = $1
+					GROUP BY ts.song_id
+					HAVING count(*) > 1) AS multiple`, categoryID).Scan(&songs); err != nil {
+				log.Printf("Tag Category PUT - Unable to check songs in category: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			if songs > 0 {
+				SendError(w, fmt.Sprintf(`{"error": "%d songs have more than one tag in this category."}`, songs), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Update category in database
+		result, err := db.Exec("UPDATE tag_categories SET name = $1, single_select = $2 WHERE category_id = $3 AND collection_id = $4", category.Name, category.SingleSelect, categoryID, collectionID)
+		if err != nil {
+			log.Printf("Tag Category PUT - Unable to update tag category in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Check if update did anything
+		if rows, err := result.RowsAffected(); err != nil {
+			log.Printf("Tag Category PUT - Database update unsuccessful: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if rows == 0 {
+			SendError(w, `{"error": "Tag category not found."}`, http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+
+	} else if r.Method == "DELETE" {
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Tag Category DELETE - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// The tags themselves are kept, just without a category
+		if _, err = tx.Exec("UPDATE tags SET category_id = NULL WHERE category_id = $1 AND collection_id = $2", category.CategoryID, category.CollectionID); err != nil {
+			log.Printf("Tag Category DELETE - Unable to remove tags from category: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag Category DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("DELETE FROM tag_categories WHERE category_id = $1 AND collection_id = $2", category.CategoryID, category.CollectionID); err != nil {
+			log.Printf("Tag Category DELETE - Unable to delete tag category from database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag Category DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Tag Category DELETE - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
+
+// checkTagAppearance verifies a tag's color and category. It returns an error message
+// for the client if they are not allowed. Use a tagID of 0 for a new tag.
+func checkTagAppearance(tagID int64, tag *Tag, collectionID int64) (string, error) {
+	if tag.Color != "" && !tagColorPattern.MatchString(tag.Color) {
+		return `{"error": "Tag color must be a hex color such as #1a2b3c."}`, nil
+	}
+
+	if tag.CategoryID == nil {
+		return "", nil
+	}
+
+	var categoryName string
+	var singleSelect bool
+	if err := db.QueryRow("SELECT name, single_select FROM tag_categories WHERE category_id = $1 AND collection_id = $2", *tag.CategoryID, collectionID).Scan(&categoryName, &singleSelect); err != nil {
+		if err == sql.ErrNoRows {
+			return `{"error": "Tag category not found."}`, nil
+		}
+		return "", err
+	}
+
+	if !singleSelect || tagID == 0 {
+		return "", nil
+	}
+
+	// Moving a tag into a single select category can't leave a song with two tags from it
+	var songs int64
+	if err := db.QueryRow(`
+		SELECT count(DISTINCT ts.song_id)
+		FROM tagged_songs AS ts
+		JOIN tagged_songs AS other ON other.song_id = ts.song_id AND other.tag_id <> ts.tag_id
+		JOIN tags AS t ON t.tag_id = other.tag_id
+		WHERE ts.tag_id = $1 AND t.category_id = $2`, tagID, *tag.CategoryID).Scan(&songs); err != nil {
+		return "", err
+	}
+
+	if songs > 0 {
+		message, _ := json.Marshal(map[string]string{"error": fmt.Sprintf("%d songs with this tag already have a %s tag.", songs, categoryName)})
+		return string(message), nil
+	}
+
+	return "", nil
+}
+
+// checkSingleSelect verifies that adding a tag to a song won't give it a second tag
+// from a single select category. It returns an error message for the client if it would.
+func checkSingleSelect(songID, tagID int64) (string, error) {
+	var categoryName, otherTag string
+	if err := db.QueryRow(`
+		SELECT c.name, other.name
+		FROM tags AS t
+		JOIN tag_categories AS c ON c.category_id = t.category_id AND c.single_select
+		JOIN tags AS other ON other.category_id = t.category_id AND other.tag_id <> t.tag_id
+		JOIN tagged_songs AS ts ON ts.tag_id = other.tag_id
+		WHERE t.tag_id = $1 AND ts.song_id = $2
+		LIMIT 1`, tagID, songID).Scan(&categoryName, &otherTag); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	message, _ := json.Marshal(map[string]string{"error": fmt.Sprintf("This song already has the %s tag %s.", categoryName, otherTag)})
+	return string(message), nil
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// TagMergeRequest models the request body for merging a tag into another tag
+type TagMergeRequest struct {
+	TargetTagID int64 `json:"target_tag_id"`
+}
+
+// TagMergeSummary describes the songs affected by merging two tags
+type TagMergeSummary struct {
+	SourceSongs    int64 `json:"source_songs"`
+	TargetSongs    int64 `json:"target_songs"`
+	AlreadyTagged  int64 `json:"already_tagged"`
+	ResultingSongs int64 `json:"resulting_songs"`
+}
+
+// TagSplitRequest models the request body for moving some of a tag's songs into a new tag
+type TagSplitRequest struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	SongIDs     []int64 `json:"song_ids"`
+}
+
+// TagSplitSummary describes the result of splitting a tag
+type TagSplitSummary struct {
+	TagID int64 `json:"tag_id,omitempty"`
+	Songs int64 `json:"songs"`
+}
+
+// TagRename is a single tag name change
+type TagRename struct {
+	TagID   int64  `json:"tag_id"`
+	Name    string `json:"name"`
+	OldName string `json:"old_name,omitempty"`
+	Songs   int64  `json:"songs"`
+}
+
+// TagRenameRequest models the request body for renaming many tags at once.
+// Normalize may be "lower", "upper" or "title" to change the case of every tag in the collection.
+type TagRenameRequest struct {
+	Renames   []TagRename `json:"renames"`
+	Normalize string      `json:"normalize"`
+}
+
+// TagRenameResponse lists the renamed tags, and any names that would be shared by more than one tag
+type TagRenameResponse struct {
+	Renames   []TagRename `json:"renames"`
+	Conflicts []string    `json:"conflicts"`
+}
+
+// isPreview checks if the request only asks what an operation would change
+func isPreview(r *http.Request) bool {
+	preview, _ := strconv.ParseBool(r.URL.Query().Get("preview"))
+	return preview
+}
+
+// TagMergeHandler handles merging a tag into another tag, then deleting it.
+func TagMergeHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("TagMerge handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	sourceID, err := strconv.ParseInt(mux.Vars(r)["tag_id"], 10, 64)
+	if err != nil {
+		log.Printf("TagMerge handler - Unable to parse tag id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		var merge TagMergeRequest
+		if err := json.NewDecoder(r.Body).Decode(&merge); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("TagMerge POST - Unable to parse request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		if merge.TargetTagID == sourceID {
+			SendError(w, `{"error": "A tag cannot be merged into itself."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Both tags must be in this collection
+		var tagsFound int
+		if err = db.QueryRow("SELECT count(*) FROM tags WHERE tag_id IN ($1, $2) AND collection_id = $3", sourceID, merge.TargetTagID, collectionID).Scan(&tagsFound); err != nil {
+			log.Printf("TagMerge POST - Unable to verify tags: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if tagsFound != 2 {
+			SendError(w, `{"error": "Tag not found."}`, http.StatusNotFound)
+			return
+		}
+
+		// Songs can't end up with two tags from the target's single select category
+		var conflicts int64
+		if err = db.QueryRow(`
+			SELECT count(DISTINCT ts.song_id)
+			FROM tagged_songs AS ts
+			JOIN tags AS target ON target.tag_id = $2
+			JOIN tag_categories AS c ON c.category_id = target.category_id AND c.single_select
+			JOIN tagged_songs AS other ON other.song_id = ts.song_id AND other.tag_id NOT IN ($1, $2)
+			JOIN tags AS t ON t.tag_id = other.tag_id AND t.category_id = target.category_id
+			WHERE ts.tag_id = $1`, sourceID, merge.TargetTagID).Scan(&conflicts); err != nil {
+			log.Printf("TagMerge POST - Unable to check tag category: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if conflicts > 0 {
+			SendError(w, fmt.Sprintf(`{"error": "%d songs would have more than one tag in the target tag's category."}`, conflicts), http.StatusBadRequest)
+			return
+		}
+
+		// Count the affected songs
+		var summary TagMergeSummary
+		if err = db.QueryRow(`
+			SELECT count(*) FILTER (WHERE tag_id = $1),
+			       count(*) FILTER (WHERE tag_id = $2),
+			       count(DISTINCT song_id) FILTER (WHERE song_id IN (SELECT song_id FROM tagged_songs WHERE tag_id = $1)
+			                                         AND song_id IN (SELECT song_id FROM tagged_songs WHERE tag_id = $2)),
+			       count(DISTINCT song_id)
+			FROM tagged_songs
+			WHERE tag_id IN ($1, $2)`, sourceID, merge.TargetTagID).Scan(&summary.SourceSongs, &summary.TargetSongs, &summary.AlreadyTagged, &summary.ResultingSongs); err != nil {
+			log.Printf("TagMerge POST - Unable to count tagged songs: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if !isPreview(r) {
+			tx, err := db.Begin()
+			if err != nil {
+				log.Printf("TagMerge POST - Unable to start database transaction: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			if err = mergeTag(tx, collectionID, sourceID, merge.TargetTagID); err != nil {
+				log.Printf("TagMerge POST - Unable to merge tag %d into tag %d: %v\n", sourceID, merge.TargetTagID, err)
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					log.Printf("TagMerge POST - Unable to rollback transaction: %v\n", rollbackErr)
+				}
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			if err = tx.Commit(); err != nil {
+				log.Printf("TagMerge POST - Unable to commit database transaction: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			log.Printf("TagMerge POST - Merged tag %d into tag %d in collection %d\n", sourceID, merge.TargetTagID, collectionID)
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(summary)
+		return
+	}
+}
+
+// mergeTag moves every song and child tag from one tag to another, then deletes the source tag
+func mergeTag(tx *sql.Tx, collectionID, sourceID, targetID int64) error {
+	// If the target is inside the source, lift it into the source's place first so reparenting can't create a cycle
+	if _, err := tx.Exec(`
+		UPDATE tags SET parent_id = (SELECT parent_id FROM tags WHERE tag_id = $1)
+		WHERE tag_id = $2
+		  AND EXISTS (SELECT 1 FROM tag_ancestors WHERE tag_id = $2 AND ancestor_id = $1)`, sourceID, targetID); err != nil {
+		log.Printf("mergeTag - Unable to move target tag: %v\n", err)
+		return err
+	}
+
+	// Move child tags
+	if _, err := tx.Exec("UPDATE tags SET parent_id = $1 WHERE parent_id = $2", targetID, sourceID); err != nil {
+		log.Printf("mergeTag - Unable to move child tags: %v\n", err)
+		return err
+	}
+
+	// Move tagged songs, skipping songs that already have the target tag
+	if _, err := tx.Exec("INSERT INTO tagged_songs(song_id, tag_id, rule_id) SELECT song_id, $1, rule_id FROM tagged_songs WHERE tag_id = $2 ON CONFLICT DO NOTHING", targetID, sourceID); err != nil {
+		log.Printf("mergeTag - Unable to move tagged songs: %v\n", err)
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM tagged_songs WHERE tag_id = $1", sourceID); err != nil {
+		log.Printf("mergeTag - Unable to remove source tagged songs: %v\n", err)
+		return err
+	}
+
+	// Tagging rules now assign the target tag
+	if _, err := tx.Exec("UPDATE tag_rules SET tag_id = $1 WHERE tag_id = $2", targetID, sourceID); err != nil {
+		log.Printf("mergeTag - Unable to move tag rules: %v\n", err)
+		return err
+	}
+
+	// Point saved searches at the target tag
+	if err := replaceSavedSearchTag(tx, collectionID, sourceID, targetID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM tags WHERE tag_id = $1 AND collection_id = $2", sourceID, collectionID); err != nil {
+		log.Printf("mergeTag - Unable to delete source tag: %v\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// replaceSavedSearchTag replaces a tag ID in every saved search in a collection.
+// A newTagID of 0 removes the tag from the saved searches instead.
+func replaceSavedSearchTag(tx *sql.Tx, collectionID, oldTagID, newTagID int64) error {
+	rows, err := tx.Query("SELECT saved_search_id, search FROM saved_searches WHERE collection_id = $1", collectionID)
+	if err != nil {
+		log.Printf("replaceSavedSearchTag - Unable to retrieve saved searches: %v\n", err)
+		return err
+	}
+
+	updated := make(map[int64][]byte)
+	for rows.Next() {
+		var savedSearchID int64
+		var encodedSearch []byte
+		var search AdvancedSearchRequest
+		if err := rows.Scan(&savedSearchID, &encodedSearch); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := json.Unmarshal(encodedSearch, &search); err != nil {
+			log.Printf("replaceSavedSearchTag - Unable to decode saved search %d: %v\n", savedSearchID, err)
+			continue
+		}
+
+		changed := false
+		for _, tags := range []*[]int64{&search.Tags, &search.AllTags, &search.ExcludeTags} {
+			replaced := make([]int64, 0, len(*tags))
+			found := false
+			for _, tagID := range *tags {
+				if tagID != oldTagID {
+					replaced = append(replaced, tagID)
+					continue
+				}
+				found = true
+				if newTagID != 0 {
+					replaced = append(replaced, newTagID)
+				}
+			}
+			if found {
+				*tags = uniqueIDs(replaced)
+				changed = true
+			}
+		}
+
+		if changed {
+			if updated[savedSearchID], err = json.Marshal(search); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		log.Printf("replaceSavedSearchTag - Unable to read saved searches: %v\n", err)
+		return err
+	}
+
+	for savedSearchID, encodedSearch := range updated {
+		if _, err := tx.Exec("UPDATE saved_searches SET search = $1 WHERE saved_search_id = $2", encodedSearch, savedSearchID); err != nil {
+			log.Printf("replaceSavedSearchTag - Unable to update saved search %d: %v\n", savedSearchID, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TagSplitHandler handles moving some of a tag's songs into a new tag with the same parent.
+func TagSplitHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("TagSplit handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	sourceID, err := strconv.ParseInt(mux.Vars(r)["tag_id"], 10, 64)
+	if err != nil {
+		log.Printf("TagSplit handler - Unable to parse tag id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		var split TagSplitRequest
+		if err := json.NewDecoder(r.Body).Decode(&split); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("TagSplit POST - Unable to parse request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if split.Name == "" {
+			SendError(w, `{"error": "No tag name supplied."}`, http.StatusBadRequest)
+			return
+		}
+
+		if len(split.SongIDs) == 0 {
+			SendError(w, `{"error": "You must provide a list of at least 1 song."}`, http.StatusBadRequest)
+			return
+		}
+
+		var parentID, categoryID *int64
+		var color, icon string
+		if err = db.QueryRow("SELECT parent_id, category_id, COALESCE(color, ''), COALESCE(icon, '') FROM tags WHERE tag_id = $1 AND collection_id = $2", sourceID, collectionID).Scan(&parentID, &categoryID, &color, &icon); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Tag not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("TagSplit POST - Unable to get tag from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var summary TagSplitSummary
+		if isPreview(r) {
+			if err = db.QueryRow("SELECT count(*) FROM tagged_songs WHERE tag_id = $1 AND song_id = ANY($2)", sourceID, pq.Array(split.SongIDs)).Scan(&summary.Songs); err != nil {
+				log.Printf("TagSplit POST - Unable to count tagged songs: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+		} else {
+			tx, err := db.Begin()
+			if err != nil {
+				log.Printf("TagSplit POST - Unable to start database transaction: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			// Create the new tag beside the old one, in the same category
+			if err = tx.QueryRow("INSERT INTO tags(name, description, parent_id, color, icon, category_id, collection_id) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING tag_id",
+				split.Name, split.Description, parentID, color, icon, categoryID, collectionID).Scan(&summary.TagID); err != nil {
+				log.Printf("TagSplit POST - Unable to create tag: %v\n", err)
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					log.Printf("TagSplit POST - Unable to rollback transaction: %v\n", rollbackErr)
+				}
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			// Move the selected songs. The source tag's rules don't apply to the new tag, so the songs count as tagged by hand.
+			var result sql.Result
+			if result, err = tx.Exec("UPDATE tagged_songs SET tag_id = $1, rule_id = NULL WHERE tag_id = $2 AND song_id = ANY($3)", summary.TagID, sourceID, pq.Array(split.SongIDs)); err != nil {
+				log.Printf("TagSplit POST - Unable to move tagged songs: %v\n", err)
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					log.Printf("TagSplit POST - Unable to rollback transaction: %v\n", rollbackErr)
+				}
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			if summary.Songs, err = result.RowsAffected(); err != nil {
+				log.Printf("TagSplit POST - Unable to get rows affected: %v\n", err)
+			}
+
+			if err = tx.Commit(); err != nil {
+				log.Printf("TagSplit POST - Unable to commit database transaction: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		if summary.TagID != 0 {
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		json.NewEncoder(w).Encode(summary)
+		return
+	}
+}
+
+// TagRenameHandler handles renaming or normalizing the case of many tags at once.
+func TagRenameHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("TagRename handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		var request TagRenameRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("TagRename POST - Unable to parse request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		var normalize func(string) string
+		switch request.Normalize {
+		case "":
+		case "lower":
+			normalize = strings.ToLower
+		case "upper":
+			normalize = strings.ToUpper
+		case "title":
+			normalize = titleCase
+		default:
+			SendError(w, `{"error": "Unknown normalization. Use lower, upper or title."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Get every tag in the collection with its song count
+		rows, err := db.Query("SELECT tags.tag_id, name, count(song_id) FROM tags LEFT JOIN tagged_songs ON tags.tag_id = tagged_songs.tag_id WHERE collection_id = $1 GROUP BY tags.tag_id ORDER BY name", collectionID)
+		if err != nil {
+			log.Printf("TagRename POST - Unable to retrieve tags from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		tags := make([]TagRename, 0)
+		tagIndex := make(map[int64]int)
+		for rows.Next() {
+			var tag TagRename
+			if err := rows.Scan(&tag.TagID, &tag.OldName, &tag.Songs); err != nil {
+				log.Printf("TagRename POST - Unable to retrieve row from database result: %v\n", err)
+				continue
+			}
+			tag.Name = tag.OldName
+			tagIndex[tag.TagID] = len(tags)
+			tags = append(tags, tag)
+		}
+
+		if err := rows.Err(); err != nil {
+			log.Printf("TagRename POST - Unable to get tags from database result: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Apply explicit renames, then normalization
+		for _, rename := range request.Renames {
+			i, ok := tagIndex[rename.TagID]
+			if !ok {
+				SendError(w, `{"error": "Tag not found."}`, http.StatusNotFound)
+				return
+			}
+
+			if strings.TrimSpace(rename.Name) == "" {
+				SendError(w, `{"error": "No tag name supplied."}`, http.StatusBadRequest)
+				return
+			}
+			tags[i].Name = strings.TrimSpace(rename.Name)
+		}
+
+		response := TagRenameResponse{make([]TagRename, 0), make([]string, 0)}
+		namesInUse := make(map[string]int)
+		for i := range tags {
+			if normalize != nil {
+				tags[i].Name = normalize(tags[i].Name)
+			}
+			if tags[i].Name != tags[i].OldName {
+				response.Renames = append(response.Renames, tags[i])
+			}
+			namesInUse[strings.ToLower(tags[i].Name)]++
+		}
+
+		// Two tags ending up with the same name should be merged instead
+		for _, tag := range tags {
+			if namesInUse[strings.ToLower(tag.Name)] > 1 {
+				response.Conflicts = append(response.Conflicts, tag.Name)
+				namesInUse[strings.ToLower(tag.Name)] = 0
+			}
+		}
+
+		if !isPreview(r) {
+			if len(response.Conflicts) > 0 {
+				log.Printf("TagRename POST - Renaming tags in collection %d would duplicate tag names %v\n", collectionID, response.Conflicts)
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+
+			tx, err := db.Begin()
+			if err != nil {
+				log.Printf("TagRename POST - Unable to start database transaction: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			for _, rename := range response.Renames {
+				if _, err = tx.Exec("UPDATE tags SET name = $1 WHERE tag_id = $2 AND collection_id = $3", rename.Name, rename.TagID, collectionID); err != nil {
+					log.Printf("TagRename POST - Unable to rename tag %d: %v\n", rename.TagID, err)
+					if rollbackErr := tx.Rollback(); rollbackErr != nil {
+						log.Printf("TagRename POST - Unable to rollback transaction: %v\n", rollbackErr)
+					}
+					SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+					return
+				}
+			}
+
+			if err = tx.Commit(); err != nil {
+				log.Printf("TagRename POST - Unable to commit database transaction: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+}
+
+// titleCase capitalizes the first letter of each word and lowercases the rest
+func titleCase(name string) string {
+	runes := []rune(strings.ToLower(name))
+	for i := range runes {
+		if i == 0 || unicode.IsSpace(runes[i-1]) || runes[i-1] == '-' {
+			runes[i] = unicode.ToUpper(runes[i])
+		}
+	}
+	return string(runes)
+}
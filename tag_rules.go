@@ -0,0 +1,487 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// TagRule is a struct that models a rule that tags every song matching a condition, both in the request body, and in the DB
+type TagRule struct {
+	RuleID       int64  `json:"rule_id" db:"rule_id"`
+	Field        string `json:"field" db:"field"`
+	Operator     string `json:"operator" db:"operator"`
+	Value        string `json:"value" db:"value"`
+	TagID        int64  `json:"tag_id" db:"tag_id"`
+	CollectionID int64  `json:"collection_id" db:"collection_id"`
+}
+
+// TagRuleResult reports how many tags applying the rules added and removed
+type TagRuleResult struct {
+	TagsAdded   int64 `json:"tags_added"`
+	TagsRemoved int64 `json:"tags_removed"`
+}
+
+// Song columns that rules can test
+var tagRuleTextFields = map[string]string{
+	"name":     "s.name",
+	"artist":   "s.artist",
+	"location": "s.location",
+	"notes":    "s.notes",
+	"key":      "s.key",
+	"voicing":  "s.voicing",
+}
+
+var tagRuleDateFields = map[string]string{
+	"last_performed": "s.last_performed",
+	"date_added":     "s.date_added",
+}
+
+// Relative dates such as "2 years", used by the older_than and within operators
+var tagRuleIntervalPattern = regexp.MustCompile(`^\d+ (day|week|month|year)s?$`)
+
+// TagRulesHandler handles GETting all tagging rules or POSTing a new rule.
+func TagRulesHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Tag Rules handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		rules, err := getTagRules(collectionID)
+		if err != nil {
+			log.Printf("Tag Rules GET - Unable to retrieve tag rules from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rules)
+		return
+
+	} else if r.Method == "POST" {
+		var rule TagRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Tag Rules POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		rule.CollectionID = collectionID
+		if message, err := checkTagRule(&rule); err != nil {
+			log.Printf("Tag Rules POST - Unable to verify tag rule: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
+		// Create rule in database
+		if err = db.QueryRow("INSERT INTO tag_rules(field, operator, value, tag_id, collection_id) VALUES ($1, $2, $3, $4, $5) RETURNING rule_id",
+			rule.Field, rule.Operator, rule.Value, rule.TagID, collectionID).Scan(&rule.RuleID); err != nil {
+			log.Printf("Tag Rules POST - Unable to insert tag rule in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Tag the existing songs
+		if _, err = applyTagRulesNow(collectionID, nil); err != nil {
+			log.Printf("Tag Rules POST - Unable to apply tag rules: %v\n", err)
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+		return
+	}
+}
+
+// TagRuleHandler handles GETting, updating, or deleting a single tagging rule.
+func TagRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule TagRule
+	var err error
+
+	// Get URL parameters
+	rule.CollectionID, err = strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Tag Rule handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	rule.RuleID, err = strconv.ParseInt(mux.Vars(r)["rule_id"], 10, 64)
+	if err != nil {
+		log.Printf("Tag Rule handler - Unable to parse rule id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		if err = db.QueryRow("SELECT field, operator, value, tag_id FROM tag_rules WHERE rule_id = $1 AND collection_id = $2", rule.RuleID, rule.CollectionID).Scan(&rule.Field, &rule.Operator, &rule.Value, &rule.TagID); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Tag rule not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Tag Rule GET - Unable to get tag rule from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rule)
+		return
+
+	} else if r.Method == "PUT" {
+		// Save the URL IDs so the user can't update another record
+		var collectionID = rule.CollectionID
+		var ruleID = rule.RuleID
+
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Tag Rule PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		rule.CollectionID = collectionID
+		if message, err := checkTagRule(&rule); err != nil {
+			log.Printf("Tag Rule PUT - Unable to verify tag rule: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Tag Rule PUT - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Tags from the old version of the rule are reassigned when the rules are applied
+		if _, err = tx.Exec("DELETE FROM tagged_songs WHERE rule_id = (SELECT rule_id FROM tag_rules WHERE rule_id = $1 AND collection_id = $2)", ruleID, collectionID); err != nil {
+			log.Printf("Tag Rule PUT - Unable to remove tags assigned by rule: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag Rule PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		var result sql.Result
+		if result, err = tx.Exec("UPDATE tag_rules SET field = $1, operator = $2, value = $3, tag_id = $4 WHERE rule_id = $5 AND collection_id = $6",
+			rule.Field, rule.Operator, rule.Value, rule.TagID, ruleID, collectionID); err != nil {
+			log.Printf("Tag Rule PUT - Unable to update tag rule in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag Rule PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag Rule PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, `{"error": "Tag rule not found."}`, http.StatusNotFound)
+			return
+		}
+
+		if _, err = applyTagRules(tx, collectionID, nil); err != nil {
+			log.Printf("Tag Rule PUT - Unable to apply tag rules: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag Rule PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Tag Rule PUT - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+
+	} else if r.Method == "DELETE" {
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Tag Rule DELETE - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Remove the tags this rule assigned
+		if _, err = tx.Exec("DELETE FROM tagged_songs WHERE rule_id = (SELECT rule_id FROM tag_rules WHERE rule_id = $1 AND collection_id = $2)", rule.RuleID, rule.CollectionID); err != nil {
+			log.Printf("Tag Rule DELETE - Unable to remove tags assigned by rule: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag Rule DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("DELETE FROM tag_rules WHERE rule_id = $1 AND collection_id = $2", rule.RuleID, rule.CollectionID); err != nil {
+			log.Printf("Tag Rule DELETE - Unable to delete tag rule from database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag Rule DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Tag Rule DELETE - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
+
+// TagRulesApplyHandler handles re-applying every tagging rule to every song in a collection.
+// Rules on dates, such as songs not performed in 2 years, change over time and need to be re-applied.
+func TagRulesApplyHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Tag Rules Apply handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		result, err := applyTagRulesNow(collectionID, nil)
+		if err != nil {
+			log.Printf("Tag Rules Apply POST - Unable to apply tag rules: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Tag Rules Apply POST - Added %d and removed %d tags in collection %d\n", result.TagsAdded, result.TagsRemoved, collectionID)
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+}
+
+// getTagRules gets every tagging rule in a collection
+func getTagRules(collectionID int64) ([]TagRule, error) {
+	rows, err := db.Query("SELECT rule_id, field, operator, value, tag_id FROM tag_rules WHERE collection_id = $1 ORDER BY rule_id", collectionID)
+	if err != nil {
+		return nil, err
+	}
+	return scanTagRules(rows, collectionID)
+}
+
+// scanTagRules reads tagging rules from a database result
+func scanTagRules(rows *sql.Rows, collectionID int64) ([]TagRule, error) {
+	defer rows.Close()
+
+	rules := make([]TagRule, 0)
+	for rows.Next() {
+		rule := TagRule{CollectionID: collectionID}
+		if err := rows.Scan(&rule.RuleID, &rule.Field, &rule.Operator, &rule.Value, &rule.TagID); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// checkTagRule verifies a rule's field, operator, value and tag. It returns an error message for the client if the rule is not valid.
+func checkTagRule(rule *TagRule) (string, error) {
+	if _, _, err := compileTagRule(*rule, 1); err != nil {
+		message, _ := json.Marshal(map[string]string{"error": err.Error()})
+		return string(message), nil
+	}
+
+	var tagFound bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM tags WHERE tag_id = $1 AND collection_id = $2)", rule.TagID, rule.CollectionID).Scan(&tagFound); err != nil {
+		return "", err
+	}
+
+	if !tagFound {
+		return `{"error": "Tag not found."}`, nil
+	}
+
+	return "", nil
+}
+
+// compileTagRule turns a rule into a SQL condition on the songs table, aliased as s.
+// Placeholders in the condition are numbered from firstArg.
+func compileTagRule(rule TagRule, firstArg int) (string, []interface{}, error) {
+	placeholder := fmt.Sprintf("$%d", firstArg)
+
+	if column, ok := tagRuleTextFields[rule.Field]; ok {
+		switch rule.Operator {
+		case "contains":
+			return fmt.Sprintf("%s ILIKE '%%' || %s || '%%'", column, placeholder), []interface{}{escapeLike(rule.Value)}, nil
+		case "starts_with":
+			return fmt.Sprintf("%s ILIKE %s || '%%'", column, placeholder), []interface{}{escapeLike(rule.Value)}, nil
+		case "equals":
+			return fmt.Sprintf("lower(%s) = lower(%s)", column, placeholder), []interface{}{rule.Value}, nil
+		case "is_empty":
+			return fmt.Sprintf("COALESCE(%s, '') = ''", column), nil, nil
+		case "is_not_empty":
+			return fmt.Sprintf("COALESCE(%s, '') <> ''", column), nil, nil
+		}
+		return "", nil, fmt.Errorf("Unknown operator '%s' for %s. Use contains, starts_with, equals, is_empty or is_not_empty.", rule.Operator, rule.Field)
+	}
+
+	if column, ok := tagRuleDateFields[rule.Field]; ok {
+		switch rule.Operator {
+		case "before", "after":
+			if _, err := time.Parse("2006-01-02", rule.Value); err != nil {
+				return "", nil, fmt.Errorf("The %s operator needs a date such as 2020-01-31.", rule.Operator)
+			}
+			comparison := "<"
+			if rule.Operator == "after" {
+				comparison = ">"
+			}
+			return fmt.Sprintf("%s %s %s::date", column, comparison, placeholder), []interface{}{rule.Value}, nil
+		case "older_than", "within":
+			if !tagRuleIntervalPattern.MatchString(rule.Value) {
+				return "", nil, fmt.Errorf("The %s operator needs a length of time such as 2 years.", rule.Operator)
+			}
+			if rule.Operator == "within" {
+				return fmt.Sprintf("%s >= CURRENT_DATE - %s::interval", column, placeholder), []interface{}{rule.Value}, nil
+			}
+			// A song that was never performed has gone longer than any length of time
+			return fmt.Sprintf("(%s IS NULL OR %s < CURRENT_DATE - %s::interval)", column, column, placeholder), []interface{}{rule.Value}, nil
+		case "is_empty":
+			return fmt.Sprintf("%s IS NULL", column), nil, nil
+		case "is_not_empty":
+			return fmt.Sprintf("%s IS NOT NULL", column), nil, nil
+		}
+		return "", nil, fmt.Errorf("Unknown operator '%s' for %s. Use before, after, older_than, within, is_empty or is_not_empty.", rule.Operator, rule.Field)
+	}
+
+	return "", nil, fmt.Errorf("Unknown field '%s'.", rule.Field)
+}
+
+// applyTagRulesNow applies a collection's tagging rules in a new transaction
+func applyTagRulesNow(collectionID int64, songIDs []int64) (TagRuleResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return TagRuleResult{}, err
+	}
+
+	result, err := applyTagRules(tx, collectionID, songIDs)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Printf("applyTagRulesNow - Unable to rollback transaction: %v\n", rollbackErr)
+		}
+		return result, err
+	}
+
+	return result, tx.Commit()
+}
+
+// applyTagRules tags the songs that match each of a collection's rules, and untags the
+// songs a rule tagged that no longer match. Tags added by hand are never removed.
+// A nil songIDs applies the rules to every song in the collection.
+func applyTagRules(tx *sql.Tx, collectionID int64, songIDs []int64) (TagRuleResult, error) {
+	var result TagRuleResult
+
+	rows, err := tx.Query("SELECT rule_id, field, operator, value, tag_id FROM tag_rules WHERE collection_id = $1 ORDER BY rule_id", collectionID)
+	if err != nil {
+		return result, err
+	}
+
+	rules, err := scanTagRules(rows, collectionID)
+	if err != nil {
+		return result, err
+	}
+
+	// Remove every outdated tag first, so that another rule for the same tag can take its place
+	for _, rule := range rules {
+		condition, args, err := compileTagRule(rule, 3)
+		if err != nil {
+			log.Printf("applyTagRules - Skipping invalid rule %d: %v\n", rule.RuleID, err)
+			continue
+		}
+
+		removed, err := tx.Exec(fmt.Sprintf(`
+			DELETE FROM tagged_songs AS ts
+			USING songs AS s
+			WHERE ts.song_id = s.song_id AND ts.rule_id = $1
+			  AND ($2::integer[] IS NULL OR s.song_id = ANY($2))
+			  AND NOT COALESCE(%s, false)`, condition), append([]interface{}{rule.RuleID, pq.Array(songIDs)}, args...)...)
+		if err != nil {
+			return result, err
+		}
+
+		if rows, err := removed.RowsAffected(); err == nil {
+			result.TagsRemoved += rows
+		}
+	}
+
+	for _, rule := range rules {
+		condition, args, err := compileTagRule(rule, 5)
+		if err != nil {
+			continue
+		}
+
+		// Skip songs that already have the tag, or another tag from its single select category
+		added, err := tx.Exec(fmt.Sprintf(`
+			INSERT INTO tagged_songs(song_id, tag_id, rule_id)
+			SELECT s.song_id, $1, $2
+			FROM songs AS s
+			WHERE s.collection_id = $3
+			  AND ($4::integer[] IS NULL OR s.song_id = ANY($4))
+			  AND COALESCE(%s, false)
+			  AND NOT EXISTS (
+			      SELECT 1
+			      FROM tags AS t
+			      JOIN tag_categories AS c ON c.category_id = t.category_id AND c.single_select
+			      JOIN tags AS other ON other.category_id = t.category_id AND other.tag_id <> t.tag_id
+			      JOIN tagged_songs AS ts ON ts.tag_id = other.tag_id
+			      WHERE t.tag_id = $1 AND ts.song_id = s.song_id)
+			ON CONFLICT DO NOTHING`, condition), append([]interface{}{rule.TagID, rule.RuleID, collectionID, pq.Array(songIDs)}, args...)...)
+		if err != nil {
+			return result, err
+		}
+
+		if rows, err := added.RowsAffected(); err == nil {
+			result.TagsAdded += rows
+		}
+	}
+
+	return result, nil
+}
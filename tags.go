@@ -17,7 +17,18 @@ type Tag struct {
 	TagID        int64  `json:"tag_id" db:"tag_id"`
 	Name         string `json:"name" db:"name"`
 	Description  string `json:"description" db:"description"`
+	ParentID     *int64 `json:"parent_id" db:"parent_id"`
+	Color        string `json:"color" db:"color"`
+	Icon         string `json:"icon" db:"icon"`
+	CategoryID   *int64 `json:"category_id" db:"category_id"`
+	Category     string `json:"category,omitempty"`
 	CollectionID int64  `json:"collection_id" db:"collection_id"`
+
+	// Set when this is a saved search listed alongside the tags, rather than a tag
+	SavedSearchID *int64 `json:"saved_search_id,omitempty"`
+
+	// Set when a tagging rule assigned this tag to a song, rather than a person
+	RuleID *int64 `json:"rule_id,omitempty"`
 }
 
 // TagsHandler handles GETting all tags or POSTing a new tag.
@@ -41,7 +52,11 @@ func TagsHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		// Retrieve Tags in collection
-		rows, err := db.Query("SELECT tag_id, name, description FROM tags WHERE collection_id = $1", collectionID)
+		rows, err := db.Query(`
+			SELECT tag_id, tags.name, description, parent_id, COALESCE(color, ''), COALESCE(icon, ''), tags.category_id, COALESCE(tag_categories.name, '')
+			FROM tags
+			LEFT JOIN tag_categories ON tag_categories.category_id = tags.category_id
+			WHERE tags.collection_id = $1`, collectionID)
 		if err != nil {
 			log.Printf("Tags GET - Unable to retrieve tags from database: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
@@ -53,7 +68,7 @@ func TagsHandler(w http.ResponseWriter, r *http.Request) {
 		tags := make([]Tag, 0)
 		for rows.Next() {
 			var tag Tag
-			if err := rows.Scan(&tag.TagID, &tag.Name, &tag.Description); err != nil {
+			if err := rows.Scan(&tag.TagID, &tag.Name, &tag.Description, &tag.ParentID, &tag.Color, &tag.Icon, &tag.CategoryID, &tag.Category); err != nil {
 				log.Printf("Tags GET - Unable to retrieve row from database result: %v\n", err)
 				continue
 			}
@@ -67,6 +82,31 @@ func TagsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Saved searches behave like dynamic tags, so they can be listed with them
+		if r.URL.Query().Get("include_searches") == "true" {
+			session, err := store.Get(r, "session")
+			if err != nil {
+				log.Printf("Tags GET - Unable to get session: %v\n", err)
+				SendError(w, SERVER_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			searches, err := getSavedSearches(int64(collectionID), session.Values["user_id"].(int64))
+			if err != nil {
+				log.Printf("Tags GET - Unable to retrieve saved searches from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+				return
+			}
+
+			for i := range searches {
+				tags = append(tags, Tag{
+					Name:          searches[i].Name,
+					CollectionID:  searches[i].CollectionID,
+					SavedSearchID: &searches[i].SavedSearchID,
+				})
+			}
+		}
+
 		// Send response
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -92,9 +132,29 @@ func TagsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Verify the parent tag
+		if message, err := checkTagParent(0, tag.ParentID, int64(collectionID)); err != nil {
+			log.Printf("Tags POST - Unable to verify parent tag: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
+		// Verify the color and category
+		if message, err := checkTagAppearance(0, tag, int64(collectionID)); err != nil {
+			log.Printf("Tags POST - Unable to verify tag category: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if message != "" {
+			SendError(w, message, http.StatusBadRequest)
+			return
+		}
+
 		// Create collection in database
-		if _, err = db.Exec("INSERT INTO tags(name, description, collection_id) VALUES ($1, $2, $3)",
-			tag.Name, tag.Description, collectionID); err != nil {
+		if _, err = db.Exec("INSERT INTO tags(name, description, parent_id, color, icon, category_id, collection_id) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			tag.Name, tag.Description, tag.ParentID, tag.Color, tag.Icon, tag.CategoryID, collectionID); err != nil {
 			if err.(*pq.Error).Code == "23505" {
 				// Tag already exists
 				SendError(w, `{"error": "Tag already exists."}`, http.StatusBadRequest)
@@ -111,6 +171,7 @@ func TagsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // TagHandler handles creating, updating, or deleting a single tag.
+// Updating a tag only changes the fields in the request, so a null parent_id or category_id must be sent to clear them.
 func TagHandler(w http.ResponseWriter, r *http.Request) {
 	var tag Tag
 	var err error
@@ -133,7 +194,11 @@ func TagHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		// Find the tag in the database
-		if err = db.QueryRow("SELECT tag_id, name, description FROM tags WHERE collection_id = $1 AND tags.tag_id = $2", tag.CollectionID, tag.TagID).Scan(&tag.TagID, &tag.Name, &tag.Description); err != nil {
+		if err = db.QueryRow(`
+			SELECT tag_id, tags.name, description, parent_id, COALESCE(color, ''), COALESCE(icon, ''), tags.category_id, COALESCE(tag_categories.name, '')
+			FROM tags
+			LEFT JOIN tag_categories ON tag_categories.category_id = tags.category_id
+			WHERE tags.collection_id = $1 AND tags.tag_id = $2`, tag.CollectionID, tag.TagID).Scan(&tag.TagID, &tag.Name, &tag.Description, &tag.ParentID, &tag.Color, &tag.Icon, &tag.CategoryID, &tag.Category); err != nil {
 			if err == sql.ErrNoRows {
 				log.Printf("Tag GET - No tag found for collection %v and tag id %v\n", tag.CollectionID, tag.TagID)
 				w.WriteHeader(http.StatusNotFound)
@@ -151,39 +216,102 @@ func TagHandler(w http.ResponseWriter, r *http.Request) {
 		return
 
 	} else if r.Method == "PUT" {
-		// Save the URL collection ID so the user can't update another record
+		// Save the URL collection and tag IDs so the user can't update another record
 		var collectionID = tag.CollectionID
+		var tagID = tag.TagID
 
-		err := json.NewDecoder(r.Body).Decode(&tag)
+		// Start db transaction
+		tx, err := db.Begin()
 		if err != nil {
+			log.Printf("Tag PUT - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Lock the collection's tags so another update can't create a cycle between checking the parent and saving it
+		if _, err = tx.Exec("SELECT tag_id FROM tags WHERE collection_id = $1 FOR UPDATE", collectionID); err != nil {
+			log.Printf("Tag PUT - Unable to lock tags in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Start from the current tag so fields left out of the request are kept
+		if err = tx.QueryRow("SELECT name, COALESCE(description, ''), parent_id, COALESCE(color, ''), COALESCE(icon, ''), category_id FROM tags WHERE collection_id = $1 AND tag_id = $2",
+			collectionID, tagID).Scan(&tag.Name, &tag.Description, &tag.ParentID, &tag.Color, &tag.Icon, &tag.CategoryID); err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Tag not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Tag PUT - Unable to get tag from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if err = json.NewDecoder(r.Body).Decode(&tag); err != nil {
 			// If there is something wrong with the request body, return a 400 status
 			log.Printf("Tag PUT - Unable to parse request body: %v\n", err)
 			body, _ := ioutil.ReadAll(r.Body)
 			log.Printf("Body: %s\n", body)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
 			SendError(w, `{"error": "Unable to parse request."}`, http.StatusBadRequest)
 			return
 		}
 
-		// Update tag in database
-		var result sql.Result
-		if result, err = db.Exec("UPDATE tags SET name = $1, description = $2 WHERE collection_id = $3 AND tag_id = $4", tag.Name, tag.Description, collectionID, tag.TagID); err != nil {
-			log.Printf("Tag PUT - Unable to update tag in database: %v\n", err)
-			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+		// Verify the parent tag won't create a cycle
+		message, err := checkTagParent(tagID, tag.ParentID, collectionID)
+		if err == nil && message == "" {
+			message, err = checkTagCycle(tx, tagID, tag.ParentID)
+		}
+		if err != nil || message != "" {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			if err != nil {
+				log.Printf("Tag PUT - Unable to verify parent tag: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			} else {
+				SendError(w, message, http.StatusBadRequest)
+			}
 			return
 		}
 
-		// Check if update did anything
-		var rows int64
-		rows, err = result.RowsAffected()
-		if err != nil {
-			log.Printf("Tag PUT - Database update unsuccessful: %v\n", err)
+		// Verify the color and category
+		if message, err := checkTagAppearance(tagID, &tag, collectionID); err != nil || message != "" {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			if err != nil {
+				log.Printf("Tag PUT - Unable to verify tag category: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			} else {
+				SendError(w, message, http.StatusBadRequest)
+			}
+			return
+		}
+
+		// Update tag in database
+		if _, err = tx.Exec("UPDATE tags SET name = $1, description = $2, parent_id = $3, color = $4, icon = $5, category_id = $6 WHERE collection_id = $7 AND tag_id = $8",
+			tag.Name, tag.Description, tag.ParentID, tag.Color, tag.Icon, tag.CategoryID, collectionID, tagID); err != nil {
+			log.Printf("Tag PUT - Unable to update tag in database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Tag PUT - Unable to rollback transaction: %v\n", rollbackErr)
+			}
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 
-		if rows == 0 {
-			log.Printf("Tag PUT - Tag id '%v' not found in database for collection %v: %v\n", tag.TagID, tag.CollectionID, err)
-			SendError(w, `{"error": "Tag not found."}`, http.StatusNotFound)
+		// Save changes
+		if err = tx.Commit(); err != nil {
+			log.Printf("Tag PUT - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 			return
 		}
 
@@ -197,6 +325,13 @@ func TagHandler(w http.ResponseWriter, r *http.Request) {
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
 		}
 
+		// Move child tags up to this tag's parent
+		if _, err = tx.Exec("UPDATE tags SET parent_id = (SELECT parent_id FROM tags WHERE tag_id = $1) WHERE parent_id = $1 AND collection_id = $2", tag.TagID, tag.CollectionID); err != nil {
+			log.Printf("Tag DELETE - Unable to move child tags in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
 		// Removed tagged songs
 		if _, err = tx.Exec("DELETE FROM tagged_songs WHERE tag_id = $1", tag.TagID); err != nil {
 			log.Printf("Tag DELETE - Unable to remove tagged songs from database: %v\n", err)
@@ -204,6 +339,20 @@ func TagHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Remove tagging rules for this tag
+		if _, err = tx.Exec("DELETE FROM tag_rules WHERE tag_id = $1", tag.TagID); err != nil {
+			log.Printf("Tag DELETE - Unable to remove tag rules from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Remove the tag from saved searches
+		if err = replaceSavedSearchTag(tx, tag.CollectionID, tag.TagID, 0); err != nil {
+			log.Printf("Tag DELETE - Unable to remove tag from saved searches: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
 		// Delete tag
 		if _, err = tx.Exec("DELETE FROM tags WHERE collection_id = $1 AND tag_id = $2", tag.CollectionID, tag.TagID); err != nil {
 			log.Printf("Tag DELETE - Unable to delete tag from database: %v\n", err)
@@ -264,8 +413,13 @@ func TagSongsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "GET" {
-		// Retrieve Tags in collection
-		rows, err := db.Query("SELECT songs.song_id, songs.name FROM songs JOIN tagged_songs ON songs.song_id = tagged_songs.song_id WHERE collection_id = $1 AND tag_id = $2", tag.CollectionID, tag.TagID)
+		// Retrieve songs tagged with this tag or any of its descendants
+		rows, err := db.Query(`
+			SELECT DISTINCT songs.song_id, songs.name
+			FROM songs
+			JOIN tagged_songs ON songs.song_id = tagged_songs.song_id
+			JOIN tag_ancestors ON tag_ancestors.tag_id = tagged_songs.tag_id
+			WHERE collection_id = $1 AND ancestor_id = $2`, tag.CollectionID, tag.TagID)
 		if err != nil {
 			log.Printf("TagSongs GET - Unable to get tagged songs from database: %v\n", err)
 			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
@@ -298,3 +452,118 @@ func TagSongsHandler(w http.ResponseWriter, r *http.Request) {
 
 	}
 }
+
+// TagTreeNode is a tag along with its child tags
+type TagTreeNode struct {
+	Tag
+	Children []*TagTreeNode `json:"children"`
+}
+
+// TagTreeHandler handles GETting the tags of a collection arranged by parent
+func TagTreeHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("TagTree handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		rows, err := db.Query(`
+			SELECT tag_id, tags.name, description, parent_id, COALESCE(color, ''), COALESCE(icon, ''), tags.category_id, COALESCE(tag_categories.name, '')
+			FROM tags
+			LEFT JOIN tag_categories ON tag_categories.category_id = tags.category_id
+			WHERE tags.collection_id = $1
+			ORDER BY tags.name`, collectionID)
+		if err != nil {
+			log.Printf("TagTree GET - Unable to retrieve tags from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// Retrieve rows from database
+		nodes := make([]*TagTreeNode, 0)
+		nodesByID := make(map[int64]*TagTreeNode)
+		for rows.Next() {
+			node := &TagTreeNode{Children: make([]*TagTreeNode, 0)}
+			if err := rows.Scan(&node.TagID, &node.Name, &node.Description, &node.ParentID, &node.Color, &node.Icon, &node.CategoryID, &node.Category); err != nil {
+				log.Printf("TagTree GET - Unable to retrieve row from database result: %v\n", err)
+				continue
+			}
+			node.CollectionID = collectionID
+			nodes = append(nodes, node)
+			nodesByID[node.TagID] = node
+		}
+
+		// Check for errors from iterating over rows.
+		if err := rows.Err(); err != nil {
+			log.Printf("TagTree GET - Unable to get tags from database result: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Attach each tag to its parent, keeping the alphabetical order
+		roots := make([]*TagTreeNode, 0)
+		for _, node := range nodes {
+			if node.ParentID != nil {
+				if parent, ok := nodesByID[*node.ParentID]; ok {
+					parent.Children = append(parent.Children, node)
+					continue
+				}
+			}
+			roots = append(roots, node)
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(roots)
+		return
+	}
+}
+
+// checkTagParent verifies that a parent tag is in the same collection. It returns an error
+// message for the client if the parent is not allowed. Use a tagID of 0 for a new tag.
+// Existing tags also need checkTagCycle.
+func checkTagParent(tagID int64, parentID *int64, collectionID int64) (string, error) {
+	if parentID == nil {
+		return "", nil
+	}
+
+	var parentCollectionID int64
+	if err := db.QueryRow("SELECT collection_id FROM tags WHERE tag_id = $1", *parentID).Scan(&parentCollectionID); err != nil {
+		if err == sql.ErrNoRows {
+			return `{"error": "Parent tag not found."}`, nil
+		}
+		return "", err
+	}
+
+	if parentCollectionID != collectionID {
+		log.Printf("checkTagParent - Tag %d in collection %d cannot have parent %d from collection %d\n", tagID, collectionID, *parentID, parentCollectionID)
+		return `{"error": "Parent tag not found."}`, nil
+	}
+
+	return "", nil
+}
+
+// checkTagCycle verifies that a tag's new parent is neither the tag itself nor one of its child tags.
+// It should run in the same transaction as the update, after the collection's tags are locked.
+func checkTagCycle(tx *sql.Tx, tagID int64, parentID *int64) (string, error) {
+	if parentID == nil {
+		return "", nil
+	}
+
+	// The parent cannot be this tag or have this tag as an ancestor
+	var cycle bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM tag_ancestors WHERE tag_id = $1 AND ancestor_id = $2)", *parentID, tagID).Scan(&cycle); err != nil {
+		return "", err
+	}
+
+	if cycle {
+		return `{"error": "A tag cannot be placed inside itself or one of its own child tags."}`, nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Venue is a struct that models a place where a collection performs, both in the request body, and in the DB
+type Venue struct {
+	VenueID      int64  `json:"venue_id" db:"venue_id"`
+	Name         string `json:"name" db:"name"`
+	Address      string `json:"address,omitempty" db:"address"`
+	Notes        string `json:"notes,omitempty" db:"notes"`
+	CollectionID int64  `json:"collection_id" db:"collection_id"`
+}
+
+// VenuesHandler handles GETting all venues or POSTing a new venue.
+func VenuesHandler(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	collectionID, err := strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Venues handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		rows, err := db.Query("SELECT venue_id, name, COALESCE(address, ''), COALESCE(notes, '') FROM venues WHERE collection_id = $1 ORDER BY name", collectionID)
+		if err != nil {
+			log.Printf("Venues GET - Unable to retrieve venues from database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// Retrieve rows from database
+		venues := make([]Venue, 0)
+		for rows.Next() {
+			venue := Venue{CollectionID: collectionID}
+			if err := rows.Scan(&venue.VenueID, &venue.Name, &venue.Address, &venue.Notes); err != nil {
+				log.Printf("Venues GET - Unable to retrieve row from database result: %v\n", err)
+				continue
+			}
+			venues = append(venues, venue)
+		}
+
+		// Check for errors from iterating over rows.
+		if err := rows.Err(); err != nil {
+			log.Printf("Venues GET - Unable to get venues from database result: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(venues)
+		return
+
+	} else if r.Method == "POST" {
+		var venue Venue
+		if err := json.NewDecoder(r.Body).Decode(&venue); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Venues POST - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if venue.Name == "" {
+			SendError(w, `{"error": "No venue name supplied."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Create venue in database
+		venue.CollectionID = collectionID
+		if err = db.QueryRow("INSERT INTO venues(name, address, notes, collection_id) VALUES ($1, $2, $3, $4) RETURNING venue_id",
+			venue.Name, venue.Address, venue.Notes, collectionID).Scan(&venue.VenueID); err != nil {
+			log.Printf("Venues POST - Unable to insert venue in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(venue)
+		return
+	}
+}
+
+// VenueHandler handles GETting, updating, or deleting a single venue.
+func VenueHandler(w http.ResponseWriter, r *http.Request) {
+	var venue Venue
+	var err error
+
+	// Get URL parameters
+	venue.CollectionID, err = strconv.ParseInt(mux.Vars(r)["collection_id"], 10, 64)
+	if err != nil {
+		log.Printf("Venue handler - Unable to parse collection id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	venue.VenueID, err = strconv.ParseInt(mux.Vars(r)["venue_id"], 10, 64)
+	if err != nil {
+		log.Printf("Venue handler - Unable to parse venue id from URL: %v\n", err)
+		SendError(w, URL_ERROR_MESSAGE, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		if err = db.QueryRow("SELECT name, COALESCE(address, ''), COALESCE(notes, '') FROM venues WHERE venue_id = $1 AND collection_id = $2", venue.VenueID, venue.CollectionID).Scan(&venue.Name, &venue.Address, &venue.Notes); err != nil {
+			if err == sql.ErrNoRows {
+				SendError(w, `{"error": "Venue not found."}`, http.StatusNotFound)
+			} else {
+				log.Printf("Venue GET - Unable to get venue from database: %v\n", err)
+				SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Send response
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(venue)
+		return
+
+	} else if r.Method == "PUT" {
+		// Save the URL IDs so the user can't update another record
+		var collectionID = venue.CollectionID
+		var venueID = venue.VenueID
+
+		if err := json.NewDecoder(r.Body).Decode(&venue); err != nil {
+			// If there is something wrong with the request body, return a 400 status
+			log.Printf("Venue PUT - Unable to decode request body: %v\n", err)
+			body, _ := ioutil.ReadAll(r.Body)
+			log.Printf("Body: %s\n", body)
+			SendError(w, REQUEST_ERROR_MESSAGE, http.StatusBadRequest)
+			return
+		}
+
+		// Input validation
+		if venue.Name == "" {
+			SendError(w, `{"error": "No venue name supplied."}`, http.StatusBadRequest)
+			return
+		}
+
+		// Update venue in database
+		result, err := db.Exec("UPDATE venues SET name = $1, address = $2, notes = $3 WHERE venue_id = $4 AND collection_id = $5", venue.Name, venue.Address, venue.Notes, venueID, collectionID)
+		if err != nil {
+			log.Printf("Venue PUT - Unable to update venue in database: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// Check if update did anything
+		if rows, err := result.RowsAffected(); err != nil {
+			log.Printf("Venue PUT - Database update unsuccessful: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		} else if rows == 0 {
+			SendError(w, `{"error": "Venue not found."}`, http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+
+	} else if r.Method == "DELETE" {
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Venue DELETE - Unable to start database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		// The events themselves are kept, just without a venue
+		if _, err = tx.Exec("UPDATE events SET venue_id = NULL WHERE venue_id = $1 AND collection_id = $2", venue.VenueID, venue.CollectionID); err != nil {
+			log.Printf("Venue DELETE - Unable to remove venue from events: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Venue DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = tx.Exec("DELETE FROM venues WHERE venue_id = $1 AND collection_id = $2", venue.VenueID, venue.CollectionID); err != nil {
+			log.Printf("Venue DELETE - Unable to delete venue from database: %v\n", err)
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Venue DELETE - Unable to rollback transaction: %v\n", rollbackErr)
+			}
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Printf("Venue DELETE - Unable to commit database transaction: %v\n", err)
+			SendError(w, DATABASE_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}